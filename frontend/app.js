@@ -191,15 +191,10 @@ async function checkApiHealth() {
     const controller = new AbortController();
     const timeoutId = setTimeout(() => controller.abort(), 3000);
     
-    await fetch(`${API_BASE_URL}/render/html`, {
-      method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ template: "", data: {} }),
-      signal: controller.signal
-    });
+    const res = await fetch(`${API_BASE_URL}/healthz`, { signal: controller.signal });
     clearTimeout(timeoutId);
     
-    setApiStatus(true);
+    setApiStatus(res.ok);
   } catch (e) {
     setApiStatus(false);
   }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes granted to clients. ScopeAdmin grants every scope.
+const (
+	ScopeRender    = "render"
+	ScopeSave      = "save"
+	ScopePublish   = "publish"
+	ScopeUploadDMS = "upload-dms"
+	ScopeAdmin     = "admin"
+)
+
+// Headers carrying credentials
+const (
+	apiKeyHeader    = "X-API-Key"
+	clientIDHeader  = "X-Client-ID"
+	timestampHeader = "X-Timestamp"
+	signatureHeader = "X-Signature"
+)
+
+// errNoCredentials is returned by an authenticator when a request carries
+// none of the credentials it handles
+var errNoCredentials = errors.New("missing credentials")
+
+// authn is the shared authenticator chain; nil when authentication is disabled
+var authn *authChain
+
+// authClient is an authenticated caller
+type authClient struct {
+	ID     string
+	Scopes []string
+	Method string // "api-key", "hmac" or "jwt"
+}
+
+// can reports whether the client was granted scope
+func (c *authClient) can(scope string) bool {
+	return slices.Contains(c.Scopes, scope) || slices.Contains(c.Scopes, ScopeAdmin)
+}
+
+// authenticator verifies one kind of credential
+type authenticator interface {
+	// authenticate returns the client that sent r, or errNoCredentials if r
+	// doesn't carry this authenticator's credentials
+	authenticate(r *http.Request) (*authClient, error)
+}
+
+// authChain tries each authenticator in turn
+type authChain struct {
+	authenticators []authenticator
+}
+
+// newAuthChain builds the authenticators enabled in config. It returns nil
+// when no clients file or JWKS file is configured.
+func newAuthChain(cfg AuthConfig) (*authChain, error) {
+	chain := &authChain{}
+
+	if cfg.ClientsFile != "" {
+		clients, err := loadAuthClients(cfg.ClientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load auth clients: %w", err)
+		}
+		keys := apiKeyAuth{}
+		signed := hmacAuth{clients: map[string]*ClientConfig{}, maxSkew: cfg.HMACMaxSkew}
+		for _, c := range clients {
+			if c.KeySHA256 != "" {
+				keys[strings.ToLower(c.KeySHA256)] = c
+			}
+			if c.HMACSecret != "" {
+				signed.clients[c.ID] = c
+			}
+		}
+		chain.authenticators = append(chain.authenticators, keys, signed)
+		slog.Info("auth: loaded clients", "count", len(clients), "path", cfg.ClientsFile)
+	}
+
+	if cfg.JWKSFile != "" {
+		j, err := newJWTAuth(cfg)
+		if err != nil {
+			return nil, err
+		}
+		chain.authenticators = append(chain.authenticators, j)
+		slog.Info("auth: verifying JWTs", "keys", len(j.keys), "path", cfg.JWKSFile)
+	}
+
+	if len(chain.authenticators) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// authenticate returns the client that sent r
+func (c *authChain) authenticate(r *http.Request) (*authClient, error) {
+	for _, a := range c.authenticators {
+		client, err := a.authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return client, err
+	}
+	return nil, errNoCredentials
+}
+
+// authClientKey is the request context key of the authenticated client
+type authClientKey struct{}
+
+// clientFromContext returns the authenticated client of a request, or nil
+// when authentication is disabled
+func clientFromContext(ctx context.Context) *authClient {
+	c, _ := ctx.Value(authClientKey{}).(*authClient)
+	return c
+}
+
+// withAuth wraps a handler so it only runs for clients granted scope. Errors
+// are reported as 401 (no or bad credentials) or 403 (missing scope).
+func withAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authn == nil {
+			next(w, r)
+			return
+		}
+
+		client, err := authn.authenticate(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, RenderResponse{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "auth: rejected request",
+				"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="render-api"`)
+			writeJSON(w, http.StatusUnauthorized, RenderResponse{Error: "unauthorized: " + err.Error()})
+			return
+		}
+		if !client.can(scope) {
+			slog.WarnContext(r.Context(), "auth: missing scope",
+				"client", client.ID, "scope", scope, "method", r.Method, "path", r.URL.Path)
+			writeJSON(w, http.StatusForbidden, RenderResponse{Error: "forbidden: missing scope " + scope})
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), authClientKey{}, client)))
+	}
+}
+
+// ClientConfig is an API client in the auth clients file
+type ClientConfig struct {
+	ID         string   `json:"id"`
+	KeySHA256  string   `json:"key_sha256,omitempty"`  // hex SHA-256 of the client's API key
+	HMACSecret string   `json:"hmac_secret,omitempty"` // shared secret for signed requests
+	Scopes     []string `json:"scopes"`
+}
+
+// loadAuthClients reads API clients from a JSON file
+func loadAuthClients(path string) ([]*ClientConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Clients []*ClientConfig `json:"clients"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid json in %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for _, c := range file.Clients {
+		switch {
+		case c.ID == "":
+			return nil, errors.New("client without id")
+		case seen[c.ID]:
+			return nil, fmt.Errorf("duplicate client id %s", c.ID)
+		case c.KeySHA256 == "" && c.HMACSecret == "":
+			return nil, fmt.Errorf("client %s: key_sha256 or hmac_secret is required", c.ID)
+		}
+		if c.KeySHA256 != "" {
+			if b, err := hex.DecodeString(c.KeySHA256); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("client %s: key_sha256 must be a hex SHA-256", c.ID)
+			}
+		}
+		for _, s := range c.Scopes {
+			if !slices.Contains([]string{ScopeRender, ScopeSave, ScopePublish, ScopeUploadDMS, ScopeAdmin}, s) {
+				return nil, fmt.Errorf("client %s: unknown scope %q", c.ID, s)
+			}
+		}
+		seen[c.ID] = true
+	}
+	return file.Clients, nil
+}
+
+// apiKeyAuth accepts static API keys sent in X-API-Key, looked up by their SHA-256
+type apiKeyAuth map[string]*ClientConfig
+
+func (a apiKeyAuth) authenticate(r *http.Request) (*authClient, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	sum := sha256.Sum256([]byte(key))
+	c, ok := a[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+	return &authClient{ID: c.ID, Scopes: c.Scopes, Method: "api-key"}, nil
+}
+
+// hmacAuth accepts requests signed with a client's shared secret. The
+// X-Signature header is "sha256=" followed by the hex HMAC-SHA256 of
+//
+//	METHOD + "\n" + path?query + "\n" + X-Timestamp + "\n" + hex SHA-256 of the body
+//
+// and X-Timestamp (Unix seconds) must be within maxSkew of the server clock.
+type hmacAuth struct {
+	clients map[string]*ClientConfig
+	maxSkew time.Duration
+}
+
+func (a hmacAuth) authenticate(r *http.Request) (*authClient, error) {
+	id, sig := r.Header.Get(clientIDHeader), r.Header.Get(signatureHeader)
+	if id == "" || sig == "" {
+		return nil, errNoCredentials
+	}
+	c, ok := a.clients[id]
+	if !ok {
+		return nil, errors.New("invalid signature")
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return nil, errors.New("missing or invalid " + timestampHeader)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, errors.New("request timestamp outside the allowed window")
+	}
+
+	// Read the body to hash it and put it back for the handler. withBodyLimit
+	// has capped it at server.max_body_bytes.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	want := signRequest(c.HMACSecret, r.Method, r.URL.RequestURI(), ts, body)
+	if !hmac.Equal([]byte(strings.TrimPrefix(sig, "sha256=")), []byte(want)) {
+		return nil, errors.New("invalid signature")
+	}
+	return &authClient{ID: c.ID, Scopes: c.Scopes, Method: "hmac"}, nil
+}
+
+// signRequest returns the hex HMAC-SHA256 signature of a request
+func signRequest(secret, method, requestURI string, ts int64, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, requestURI, ts, hex.EncodeToString(bodySum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testAPIKey     = "k3y-for-tests"
+	testHMACSecret = "hmac-s3cret"
+	testAudience   = "render-api"
+)
+
+// useTestAuth enables authentication with one API key client, one HMAC client
+// and a JWKS holding the returned Ed25519 key
+func useTestAuth(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	dir := t.TempDir()
+
+	keySum := sha256.Sum256([]byte(testAPIKey))
+	clients := fmt.Sprintf(`{"clients": [
+		{"id": "crm", "key_sha256": %q, "scopes": ["render"]},
+		{"id": "batch", "hmac_secret": %q, "scopes": ["render", "save"]}
+	]}`, hex.EncodeToString(keySum[:]), testHMACSecret)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(pub))
+
+	cfg := AuthConfig{
+		ClientsFile: filepath.Join(dir, "clients.json"),
+		JWKSFile:    filepath.Join(dir, "jwks.json"),
+		JWTAudience: testAudience,
+		HMACMaxSkew: time.Minute,
+	}
+	for path, content := range map[string]string{cfg.ClientsFile: clients, cfg.JWKSFile: jwks} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chain, err := newAuthChain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := authn
+	t.Cleanup(func() { authn = prev })
+	authn = chain
+	return priv
+}
+
+// signedRequest returns a request signed by the HMAC client at ts
+func signedRequest(body string, ts time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/templates/save?draft=1", strings.NewReader(body))
+	r.Header.Set(clientIDHeader, "batch")
+	r.Header.Set(timestampHeader, strconv.FormatInt(ts.Unix(), 10))
+	r.Header.Set(signatureHeader, "sha256="+signRequest(testHMACSecret, r.Method, r.URL.RequestURI(), ts.Unix(), []byte(body)))
+	return r
+}
+
+// bearer returns a request carrying a JWT built from claims and signed by key
+func bearer(t *testing.T, method jwt.SigningMethod, key any, claims jwt.MapClaims) *http.Request {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/templates/list", nil)
+	r.Header.Set("Authorization", "Bearer "+signed)
+	return r
+}
+
+func TestWithAuth(t *testing.T) {
+	key := useTestAuth(t)
+	now := time.Now()
+	valid := jwt.MapClaims{"sub": "portal", "aud": testAudience, "exp": now.Add(time.Hour).Unix(), "scope": "render save"}
+	claims := func(edit func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		edit(c)
+		return c
+	}
+	withKey := func(r *http.Request, key string) *http.Request {
+		r.Header.Set(apiKeyHeader, key)
+		return r
+	}
+	hs256 := bearer(t, jwt.SigningMethodHS256, []byte("k1"), valid)
+	none := bearer(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid)
+
+	tampered := signedRequest(`{"name":"offer"}`, now)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"name":"other"}`))
+	badSig := signedRequest(`{}`, now)
+	badSig.Header.Set(signatureHeader, "sha256="+strings.Repeat("0", 64))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		scope  string
+		status int
+		client string
+	}{
+		{"no credentials", httptest.NewRequest(http.MethodGet, "/templates/list", nil), ScopeRender, http.StatusUnauthorized, ""},
+		{"api key", withKey(httptest.NewRequest(http.MethodGet, "/templates/list", nil), testAPIKey), ScopeRender, http.StatusOK, "crm"},
+		{"unknown api key", withKey(httptest.NewRequest(http.MethodGet, "/templates/list", nil), "wrong"), ScopeRender, http.StatusUnauthorized, ""},
+		{"api key without scope", withKey(httptest.NewRequest(http.MethodPost, "/templates/save", nil), testAPIKey), ScopeSave, http.StatusForbidden, ""},
+
+		{"hmac", signedRequest(`{"name":"offer"}`, now), ScopeSave, http.StatusOK, "batch"},
+		{"hmac bad signature", badSig, ScopeSave, http.StatusUnauthorized, ""},
+		{"hmac stale timestamp", signedRequest(`{}`, now.Add(-2*time.Minute)), ScopeSave, http.StatusUnauthorized, ""},
+		{"hmac future timestamp", signedRequest(`{}`, now.Add(2*time.Minute)), ScopeSave, http.StatusUnauthorized, ""},
+		{"hmac signature replayed with another body", tampered, ScopeSave, http.StatusUnauthorized, ""},
+		{"hmac without scope", signedRequest(`{}`, now), ScopePublish, http.StatusForbidden, ""},
+
+		{"jwt", bearer(t, jwt.SigningMethodEdDSA, key, valid), ScopeSave, http.StatusOK, "portal"},
+		{"jwt hs256 with the key id as secret", hs256, ScopeRender, http.StatusUnauthorized, ""},
+		{"jwt alg none", none, ScopeRender, http.StatusUnauthorized, ""},
+		{"jwt expired", bearer(t, jwt.SigningMethodEdDSA, key, claims(func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() })), ScopeRender, http.StatusUnauthorized, ""},
+		{"jwt without exp", bearer(t, jwt.SigningMethodEdDSA, key, claims(func(c jwt.MapClaims) { delete(c, "exp") })), ScopeRender, http.StatusUnauthorized, ""},
+		{"jwt wrong audience", bearer(t, jwt.SigningMethodEdDSA, key, claims(func(c jwt.MapClaims) { c["aud"] = "billing" })), ScopeRender, http.StatusUnauthorized, ""},
+		{"jwt missing scope", bearer(t, jwt.SigningMethodEdDSA, key, claims(func(c jwt.MapClaims) { c["scope"] = "render" })), ScopePublish, http.StatusForbidden, ""},
+		{"jwt admin", bearer(t, jwt.SigningMethodEdDSA, key, claims(func(c jwt.MapClaims) { c["scopes"] = []string{"admin"}; delete(c, "scope") })), ScopePublish, http.StatusOK, "portal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var client *authClient
+			var body string
+			h := withAuth(tt.scope, func(w http.ResponseWriter, r *http.Request) {
+				client = clientFromContext(r.Context())
+				b, _ := io.ReadAll(r.Body)
+				body = string(b)
+			})
+			w := httptest.NewRecorder()
+			h(w, tt.req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if tt.client != "" && (client == nil || client.ID != tt.client) {
+				t.Errorf("client = %+v, want %s", client, tt.client)
+			}
+			if tt.name == "hmac" && body != `{"name":"offer"}` {
+				t.Errorf("handler read body %q after signature check", body)
+			}
+		})
+	}
+}
+
+func TestBodyLimitBeforeAuth(t *testing.T) {
+	useTestAuth(t)
+	prev := config.Server.MaxBodyBytes
+	t.Cleanup(func() { config.Server.MaxBodyBytes = prev })
+	config.Server.MaxBodyBytes = 64
+
+	reached := false
+	h := withBodyLimit(withAuth(ScopeSave, func(http.ResponseWriter, *http.Request) { reached = true }))
+
+	w := httptest.NewRecorder()
+	h(w, signedRequest(strings.Repeat("x", 65), time.Now()))
+	if w.Code != http.StatusRequestEntityTooLarge || reached {
+		t.Errorf("oversized signed body: status %d, handler reached %v", w.Code, reached)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, signedRequest(strings.Repeat("x", 64), time.Now()))
+	if w.Code != http.StatusOK || !reached {
+		t.Errorf("body at the limit: status %d, handler reached %v", w.Code, reached)
+	}
+}
+
+func TestIPRateLimitBeforeAuth(t *testing.T) {
+	useTestAuth(t)
+	prev := limits
+	t.Cleanup(func() { limits = prev })
+	limits = &limiter{
+		ip:     &routeLimiter{route: "per-ip", limit: RouteLimit{Rate: 0.001, Burst: 2}, buckets: make(map[string]*tokenBucket)},
+		routes: make(map[string]*routeLimiter),
+	}
+
+	h := withIPRateLimit(withAuth(ScopeRender, func(http.ResponseWriter, *http.Request) {}))
+	send := func(remote string) int {
+		r := httptest.NewRequest(http.MethodGet, "/templates/list", nil)
+		r.RemoteAddr = remote
+		r.Header.Set(apiKeyHeader, "wrong")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	// Failed logins use up the address's bucket like any other request
+	for range 2 {
+		if code := send("203.0.113.7:40000"); code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", code)
+		}
+	}
+	if code := send("203.0.113.7:40001"); code != http.StatusTooManyRequests {
+		t.Errorf("third request from the same address: status %d, want 429", code)
+	}
+	if code := send("198.51.100.1:40000"); code != http.StatusUnauthorized {
+		t.Errorf("other address: status %d, want 401", code)
+	}
+	if s := limits.ip.stats(); s.Clients != 2 || s.Rejected != 1 {
+		t.Errorf("per-IP stats = %+v", s)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+func init() {
+	// Keep pdfcpu from creating a config directory in the user's home
+	api.DisableConfigDir()
+}
+
+// batchItem is the outcome of rendering one item of a batch
+type batchItem struct {
+	result BatchItemResult
+	pdf    []byte
+}
+
+// renderBatch renders every item with at most concurrency renders in flight.
+// Each render still takes a render gate slot, waiting for one rather than
+// failing since the batch was already admitted. Items fail independently;
+// their errors are reported in the results.
+func renderBatch(ctx context.Context, items []PDFRequest, concurrency int) []batchItem {
+	ctx = withRenderWait(ctx)
+	out := make([]batchItem, len(items))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			item := &items[i]
+			if item.Filename == "" {
+				item.Filename = fmt.Sprintf("document-%d", i+1)
+			}
+			res := BatchItemResult{
+				Index:    i,
+				Filename: batchFilename(item.Filename, i),
+				Status:   "ok",
+			}
+
+			if item.CallbackURL != "" {
+				res.Status = "failed"
+				res.Error = "callback_url is not supported for batch items"
+				out[i] = batchItem{result: res}
+				return
+			}
+
+			rendered, err := renderPDF(ctx, item)
+			if err != nil {
+				res.Status = "failed"
+				res.Error = err.Error()
+				out[i] = batchItem{result: res}
+				return
+			}
+			res.Size = len(rendered.PDF)
+			res.ResourceErrors = rendered.ResourceErrors
+			if rendered.stored != nil {
+				res.TemplateFile = rendered.stored.Filename
+			}
+			out[i] = batchItem{result: res, pdf: rendered.PDF}
+		}(i)
+	}
+
+	wg.Wait()
+	return out
+}
+
+// batchFilename returns the PDF file name of a batch item. A name with
+// nothing left after sanitizing falls back to one made from the item index.
+func batchFilename(name string, index int) string {
+	if safe := sanitizeName(name); safe != "" {
+		return safe + ".pdf"
+	}
+	return fmt.Sprintf("item-%d.pdf", index)
+}
+
+// batchZip packs the rendered PDFs into a ZIP along with a manifest.json
+// listing every item's outcome
+func batchZip(items []batchItem) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	used := make(map[string]int)
+	results := make([]BatchItemResult, len(items))
+	for i, item := range items {
+		if item.pdf != nil {
+			name := uniqueFilename(item.result.Filename, used)
+			item.result.Filename = name
+			f, err := zw.Create(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add %s to zip: %w", name, err)
+			}
+			if _, err := f.Write(item.pdf); err != nil {
+				return nil, fmt.Errorf("failed to add %s to zip: %w", name, err)
+			}
+		}
+		results[i] = item.result
+	}
+
+	manifest, err := json.MarshalIndent(BatchResponse{Items: results}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to add manifest to zip: %w", err)
+	}
+	if _, err := f.Write(manifest); err != nil {
+		return nil, fmt.Errorf("failed to add manifest to zip: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close zip: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// batchMerged concatenates the rendered PDFs into one document with a
+// top-level bookmark at the first page of each item
+func batchMerged(items []batchItem) ([]byte, error) {
+	var (
+		readers   []io.ReadSeeker
+		bookmarks []pdfcpu.Bookmark
+		page      = 1
+	)
+	for _, item := range items {
+		if item.pdf == nil {
+			continue
+		}
+		pages, err := api.PageCount(bytes.NewReader(item.pdf), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", item.result.Filename, err)
+		}
+		readers = append(readers, bytes.NewReader(item.pdf))
+		bookmarks = append(bookmarks, pdfcpu.Bookmark{
+			Title:    strings.TrimSuffix(item.result.Filename, ".pdf"),
+			PageFrom: page,
+		})
+		page += pages
+	}
+
+	var merged bytes.Buffer
+	if err := api.MergeRaw(readers, &merged, false, nil); err != nil {
+		return nil, fmt.Errorf("failed to merge pdfs: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := api.AddBookmarks(bytes.NewReader(merged.Bytes()), &out, bookmarks, true, nil); err != nil {
+		return nil, fmt.Errorf("failed to add bookmarks: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// uniqueFilename returns name, or name with a -2, -3... suffix if it was already used
+func uniqueFilename(name string, used map[string]int) string {
+	used[name]++
+	if used[name] == 1 {
+		return name
+	}
+	base := strings.TrimSuffix(name, ".pdf")
+	for {
+		candidate := fmt.Sprintf("%s-%d.pdf", base, used[name])
+		if used[candidate] == 0 {
+			used[candidate] = 1
+			return candidate
+		}
+		used[name]++
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBatchFilename(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		index int
+		want  string
+	}{
+		{"Lead 001", 0, "lead-001.pdf"},
+		{"???", 3, "item-3.pdf"},
+		{"  ", 0, "item-0.pdf"},
+		{"données", 1, "donnes.pdf"},
+	} {
+		if got := batchFilename(tt.name, tt.index); got != tt.want {
+			t.Errorf("batchFilename(%q, %d) = %q, want %q", tt.name, tt.index, got, tt.want)
+		}
+	}
+
+	used := make(map[string]int)
+	for i, want := range []string{"item-1.pdf", "item-1-2.pdf", "item-1-3.pdf"} {
+		if got := uniqueFilename("item-1.pdf", used); got != want {
+			t.Errorf("name %d = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"sync"
+	"time"
+)
+
+// tmplCache is the shared parsed-template cache used by the render handlers
+var tmplCache *templateCache
+
+// CacheStats reports template cache usage
+type CacheStats struct {
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+// cacheEntry is a parsed template along with the stamp it was parsed from
+type cacheEntry struct {
+	key   string
+	stamp string // file modtime and size for stored templates, empty for inline
+	size  int64  // template source length, counted against the byte limit
+	tmpl  *template.Template
+}
+
+// templateCache is an LRU cache of parsed templates bounded by entry count and
+// total source size. Inline templates are keyed by a hash of their source;
+// stored templates by file name and revalidated against the file's modtime.
+type templateCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	ll         *list.List
+	items      map[string]*list.Element
+
+	hits, misses, evictions uint64
+}
+
+// newTemplateCache creates a template cache with the given limits
+func newTemplateCache(cfg TemplateCacheConfig) *templateCache {
+	return &templateCache{
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// parseTemplate parses a template with the shared function map and options
+func parseTemplate(name, source string) (*template.Template, error) {
+	defer observeDuration(templateDuration.WithLabelValues("parse"), time.Now())
+	return template.New(name).Funcs(templateFuncMap).Option("missingkey=default").Parse(source)
+}
+
+// inline returns the parsed template for a template source sent in a request
+func (c *templateCache) inline(name, source string) (*template.Template, error) {
+	sum := sha256.Sum256([]byte(source))
+	key := "inline:" + name + ":" + hex.EncodeToString(sum[:])
+
+	if tmpl, ok := c.get(key, ""); ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := parseTemplate(name, source)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, "", int64(len(source)), tmpl)
+	return tmpl, nil
+}
+
+// stored returns the parsed template for a file in the templates directory,
+// re-reading it if the file changed since it was cached. It is parsed under
+// its file name, so every kind of render shares one entry per file.
+func (c *templateCache) stored(st *storedTemplate) (*template.Template, error) {
+	key := "stored:" + st.Filename
+	stamp := fmt.Sprintf("%d-%d", st.ModTime.UnixNano(), st.Size)
+
+	if tmpl, ok := c.get(key, stamp); ok {
+		return tmpl, nil
+	}
+
+	content, err := readTemplateFile(st.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template file: %w", err)
+	}
+	tmpl, err := parseTemplate(st.Filename, string(content))
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, stamp, int64(len(content)), tmpl)
+	return tmpl, nil
+}
+
+// get looks up a key, dropping the entry if its stamp is stale
+func (c *templateCache) get(key, stamp string) (*template.Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.stamp != stamp {
+		c.remove(el)
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+	return entry.tmpl, true
+}
+
+// add inserts a parsed template and evicts least recently used entries over the limits
+func (c *templateCache) add(key, stamp string, size int64, tmpl *template.Template) {
+	if c.maxEntries <= 0 || (c.maxBytes > 0 && size > c.maxBytes) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, stamp: stamp, size: size, tmpl: tmpl})
+	c.bytes += size
+
+	for c.ll.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// remove deletes an element; the caller must hold c.mu
+func (c *templateCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
+
+// stats returns a snapshot of cache usage
+func (c *templateCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := CacheStats{
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		s.HitRate = float64(c.hits) / float64(total)
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateCacheStored(t *testing.T) {
+	dir := t.TempDir()
+	useTemplatesDir(t, dir)
+	path := filepath.Join(dir, "offer-v1.html")
+	if err := os.WriteFile(path, []byte("<p>{{.name}}</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTemplateCache(TemplateCacheConfig{MaxEntries: 10})
+	lookup := func() {
+		t.Helper()
+		st, err := resolveStoredTemplate("offer", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.stored(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Preview and PDF renders of a file share its entry
+	lookup()
+	lookup()
+	if s := c.stats(); s.Entries != 1 || s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("after two lookups: %+v, want one entry and one hit", s)
+	}
+
+	// A changed file replaces the entry rather than adding one
+	if err := os.WriteFile(path, []byte("<p>{{.name}}!</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	lookup()
+	if s := c.stats(); s.Entries != 1 || s.Misses != 2 {
+		t.Errorf("after the file changed: %+v, want one entry and a second miss", s)
+	}
+}
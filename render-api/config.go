@@ -1,76 +1,870 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"go.yaml.in/yaml/v3"
 )
 
-// Config holds application configuration
+// Config holds application configuration. It is built in layers: built-in
+// defaults, then the YAML config file, then environment variables, then
+// command-line flags.
 type Config struct {
-	AllowedOrigins []string
-	TemplatesDir   string
-	ServerAddr     string
-	ChromePath     string
-	DMS            DMSConfig
+	AllowedOrigins []string             `yaml:"allowed_origins"`
+	TemplatesDir   string               `yaml:"templates_dir"`
+	Server         ServerConfig         `yaml:"server"`
+	Browser        BrowserConfig        `yaml:"chrome"`
+	PDF            PDFDefaultsConfig    `yaml:"pdf"`
+	TemplateCache  TemplateCacheConfig  `yaml:"template_cache"`
+	Jobs           JobsConfig           `yaml:"jobs"`
+	Webhook        WebhookConfig        `yaml:"webhooks"`
+	Batch          BatchConfig          `yaml:"batch"`
+	Images         ImageConfig          `yaml:"images"`
+	Resources      ResourcePolicyConfig `yaml:"resources"`
+	Auth           AuthConfig           `yaml:"auth"`
+	Log            LogConfig            `yaml:"log"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	Health         HealthConfig         `yaml:"health"`
+	DMS            DMSConfig            `yaml:"dms"`
+
+	// RedactionProfiles are named sets of payload fields to mask before
+	// rendering, loaded from RedactionProfilesFile
+	RedactionProfilesFile string                       `yaml:"redaction_profiles_file"`
+	RedactionProfiles     map[string]*RedactionProfile `yaml:"-"`
+}
+
+// ServerConfig holds the listen addresses, HTTP server timeouts and the shutdown deadline
+type ServerConfig struct {
+	Addr              string        `yaml:"addr"`
+	MetricsAddr       string        `yaml:"metrics_addr"`        // separate listener for /metrics; empty serves it on Addr
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // longest to read request headers
+	ReadTimeout       time.Duration `yaml:"read_timeout"`        // longest to read a whole request
+	WriteTimeout      time.Duration `yaml:"write_timeout"`       // longest to handle a request and write the response, renders included
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`        // how long keep-alive connections are kept open
+	MaxBodyBytes      int64         `yaml:"max_body_bytes"`      // largest request body accepted
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`    // how long in-flight renders may finish after SIGTERM
+}
+
+// TemplateCacheConfig holds parsed-template cache limits
+type TemplateCacheConfig struct {
+	MaxEntries int   `yaml:"max_entries"` // maximum number of parsed templates kept
+	MaxBytes   int64 `yaml:"max_bytes"`   // maximum total template source size kept
+}
+
+// BrowserConfig holds headless Chrome pool configuration
+type BrowserConfig struct {
+	ChromePath     string        `yaml:"path"`            // Chrome binary; empty finds it on the PATH
+	Flags          []string      `yaml:"flags"`           // extra command-line flags, e.g. "lang=id-ID"
+	PoolSize       int           `yaml:"pool_size"`       // number of long-lived Chrome processes
+	MaxRenders     int           `yaml:"max_renders"`     // renders per browser before it is recycled
+	HealthInterval time.Duration `yaml:"health_interval"` // how often idle browsers are pinged
+	WaitTimeout    time.Duration `yaml:"wait_timeout"`    // longest wait for a page to finish loading before printing
+	NetworkIdle    time.Duration `yaml:"network_idle"`    // how long the network must be quiet before printing
+}
+
+// PDFDefaultsConfig holds the print settings used when a request's
+// pdf_options leave them out
+type PDFDefaultsConfig struct {
+	PaperSize   string    `yaml:"paper_size"`  // used when the template has no CSS @page size; empty lets Chrome pick
+	Orientation string    `yaml:"orientation"` // portrait or landscape
+	Margin      PDFLength `yaml:"margin"`      // margin on every side, e.g. "10mm"
+}
+
+// JobsConfig holds asynchronous PDF job queue configuration
+type JobsConfig struct {
+	Workers   int           `yaml:"workers"`    // concurrent job renders
+	QueueSize int           `yaml:"queue_size"` // maximum queued jobs before submissions are rejected
+	Store     string        `yaml:"store"`      // "memory" or "disk"
+	Dir       string        `yaml:"dir"`        // job directory for the disk store
+	ResultTTL time.Duration `yaml:"result_ttl"` // how long finished jobs and their PDFs are kept
+}
+
+// WebhookConfig holds job completion webhook configuration
+type WebhookConfig struct {
+	Secret         string        `yaml:"secret"`          // default HMAC signing secret
+	MaxAttempts    int           `yaml:"max_attempts"`    // delivery attempts before giving up
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // wait before the first retry, doubled on each retry
+	MaxBackoff     time.Duration `yaml:"max_backoff"`     // upper bound on the wait between retries
+	Timeout        time.Duration `yaml:"timeout"`         // per-attempt HTTP timeout
+	PublicBaseURL  string        `yaml:"public_base_url"` // prefix for download links, e.g. https://render.example.com
+}
+
+// BatchConfig holds batch rendering limits
+type BatchConfig struct {
+	MaxItems    int `yaml:"max_items"`   // maximum items accepted in one batch request
+	Concurrency int `yaml:"concurrency"` // default and maximum renders in flight per batch; 0 uses the pool size
+}
+
+// ImageConfig holds remote image pre-fetch configuration
+type ImageConfig struct {
+	Inline       bool          `yaml:"inline"`        // pre-fetch images unless a request sets inline_images: false
+	AllowedHosts []string      `yaml:"allowed_hosts"` // hosts images may be downloaded from; empty allows all
+	MaxBytes     int64         `yaml:"max_bytes"`     // largest image downloaded
+	FetchTimeout time.Duration `yaml:"fetch_timeout"` // per-image download timeout
+	Concurrency  int           `yaml:"concurrency"`   // downloads in flight per render
+	MaxDimension int           `yaml:"max_dimension"` // larger images are downscaled to this width or height; 0 keeps them
+	MaxPixels    int           `yaml:"max_pixels"`    // images with more pixels are rejected before decoding
+	MaxCount     int           `yaml:"max_count"`     // URLs downloaded per request; the rest are reported and left as they are
+	JPEGQuality  int           `yaml:"jpeg_quality"`  // quality of re-encoded JPEGs
+	Placeholder  string        `yaml:"placeholder"`   // image file used for failed downloads (default: light gray pixel)
+}
+
+// ResourcePolicyConfig controls which URLs rendered pages and the image
+// pre-fetcher may load
+type ResourcePolicyConfig struct {
+	AllowedSchemes []string `yaml:"allowed_schemes"` // URL schemes pages may load (data: is always allowed)
+	AllowedHosts   []string `yaml:"allowed_hosts"`   // hosts pages may load from; empty allows all
+	AllowedCIDRs   []CIDR   `yaml:"allowed_cidrs"`   // address ranges allowed even when private
+	BlockPrivate   bool     `yaml:"block_private"`   // block private, loopback and link-local addresses
+	MaxBytes       int64    `yaml:"max_bytes"`       // largest response a page may load
+	AssetsDir      string   `yaml:"assets_dir"`      // local files served to pages under /assets/
+}
+
+// CIDR is an address range written as "10.0.0.0/8"
+type CIDR struct {
+	*net.IPNet
+}
+
+// UnmarshalText parses an address range in CIDR notation
+func (c *CIDR) UnmarshalText(b []byte) error {
+	_, n, err := net.ParseCIDR(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+	c.IPNet = n
+	return nil
+}
+
+// AuthConfig holds API authentication configuration. Authentication is
+// disabled when neither a clients file nor a JWKS file is set.
+type AuthConfig struct {
+	ClientsFile string        `yaml:"clients_file"`  // JSON file of API key and HMAC clients
+	JWKSFile    string        `yaml:"jwks_file"`     // JSON Web Key Set used to verify bearer JWTs
+	JWTIssuer   string        `yaml:"jwt_issuer"`    // required "iss" claim, if set
+	JWTAudience string        `yaml:"jwt_audience"`  // required "aud" claim, if set
+	HMACMaxSkew time.Duration `yaml:"hmac_max_skew"` // allowed clock difference for signed requests
+}
+
+// RateLimitConfig holds per-client request limits and the concurrent render gate
+type RateLimitConfig struct {
+	Default       RouteLimit            `yaml:"default"`        // limit for routes without their own entry
+	Routes        map[string]RouteLimit `yaml:"routes"`         // by route pattern, e.g. "/render/pdf"
+	PerIP         RouteLimit            `yaml:"per_ip"`         // limit per remote IP across all routes, applied before authentication
+	MaxConcurrent int                   `yaml:"max_concurrent"` // renders running at once across all clients; 0 uses the pool size
+	MaxQueue      int                   `yaml:"max_queue"`      // renders waiting for a slot before new ones are rejected
+	QueueTimeout  time.Duration         `yaml:"queue_timeout"`  // longest a render waits for a slot
+}
+
+// LogConfig holds logging configuration
+type LogConfig struct {
+	Level  slog.Level `yaml:"level"`  // lowest level logged
+	Format string     `yaml:"format"` // "text" or "json"
+}
+
+// TracingConfig holds OpenTelemetry tracing configuration. OTLP endpoints and
+// sampling use the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER variables.
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter"` // "otlp", "stdout" or "none"
+	ServiceName string `yaml:"service_name"`
+}
+
+// HealthConfig holds readiness check configuration
+type HealthConfig struct {
+	CacheTTL     time.Duration `yaml:"cache_ttl"`     // how long Chrome and DMS check results are reused
+	CheckTimeout time.Duration `yaml:"check_timeout"` // longest a single check may take
+	RequireDMS   bool          `yaml:"require_dms"`   // report not ready when DMS is unreachable
 }
 
 // DMSConfig holds DMS-specific configuration
 type DMSConfig struct {
-	APIURL    string
-	APISecret string
+	APIURL    string        `yaml:"api_url"`
+	APISecret string        `yaml:"api_secret"`
+	Timeout   time.Duration `yaml:"timeout"` // upload request timeout
 }
 
+// config is the configuration the API started with. A reload doesn't replace
+// it, since it is read without locking; the settings a reload may change are
+// kept in their own holders (allowedOrigins, redactionProfiles, limits and
+// logLevel).
 var config Config
 
+// configFile is the YAML config file given with -config or CONFIG_FILE
+var configFile string
+
+// defaultConfig returns the built-in defaults, the first configuration layer
+func defaultConfig() Config {
+	return Config{
+		AllowedOrigins: []string{},
+		TemplatesDir:   "../templates",
+		Server: ServerConfig{
+			Addr:              ":8080",
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      120 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   60 * time.Second,
+			MaxBodyBytes:      32 << 20,
+		},
+		Browser: BrowserConfig{
+			PoolSize:       2,
+			MaxRenders:     100,
+			HealthInterval: 30 * time.Second,
+			WaitTimeout:    15 * time.Second,
+			NetworkIdle:    250 * time.Millisecond,
+		},
+		PDF:           PDFDefaultsConfig{Margin: defaultPDFMargin},
+		TemplateCache: TemplateCacheConfig{MaxEntries: 128, MaxBytes: 64 << 20},
+		Jobs: JobsConfig{
+			Workers:   2,
+			QueueSize: 100,
+			Store:     "memory",
+			Dir:       "../jobs",
+			ResultTTL: 24 * time.Hour,
+		},
+		Webhook: WebhookConfig{
+			MaxAttempts:    5,
+			InitialBackoff: 2 * time.Second,
+			MaxBackoff:     300 * time.Second,
+			Timeout:        10 * time.Second,
+		},
+		Batch: BatchConfig{MaxItems: 100},
+		Images: ImageConfig{
+			MaxBytes:     10 << 20,
+			FetchTimeout: 10 * time.Second,
+			Concurrency:  8,
+			MaxDimension: 2000,
+			MaxPixels:    40_000_000,
+			MaxCount:     50,
+			JPEGQuality:  85,
+		},
+		Resources: ResourcePolicyConfig{
+			AllowedSchemes: []string{"http", "https"},
+			BlockPrivate:   true,
+			MaxBytes:       20 << 20,
+		},
+		Auth:    AuthConfig{HMACMaxSkew: 300 * time.Second},
+		Log:     LogConfig{Level: slog.LevelInfo, Format: "text"},
+		Tracing: TracingConfig{Exporter: "none", ServiceName: "render-api"},
+		RateLimit: RateLimitConfig{
+			Default:      RouteLimit{Rate: 0, Burst: 10},
+			Routes:       map[string]RouteLimit{},
+			PerIP:        RouteLimit{Rate: 20, Burst: 100},
+			MaxQueue:     20,
+			QueueTimeout: 30 * time.Second,
+		},
+		Health: HealthConfig{CacheTTL: 30 * time.Second, CheckTimeout: 10 * time.Second},
+		DMS:    DMSConfig{Timeout: 30 * time.Second},
+	}
+}
+
+// configFlags are the command-line flags, the last configuration layer. Only
+// flags given on the command line override the earlier layers.
+var configFlags = []struct {
+	name, usage string
+	apply       func(cfg *Config, v string) error
+}{
+	{"addr", "listen `address`, e.g. :8080", func(cfg *Config, v string) error { cfg.Server.Addr = v; return nil }},
+	{"metrics-addr", "separate metrics listen `address`", func(cfg *Config, v string) error { cfg.Server.MetricsAddr = v; return nil }},
+	{"templates-dir", "templates `directory`", func(cfg *Config, v string) error { cfg.TemplatesDir = v; return nil }},
+	{"chrome-path", "Chrome `binary`", func(cfg *Config, v string) error { cfg.Browser.ChromePath = v; return nil }},
+	{"log-level", "debug, info, warn or error", func(cfg *Config, v string) error { return cfg.Log.Level.UnmarshalText([]byte(v)) }},
+}
+
 func init() {
-	loadConfig()
+	registerConfigFlags(flag.CommandLine)
 }
 
-func loadConfig() {
+// registerConfigFlags adds -config and the configFlags to fs
+func registerConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFile, "config", "", "YAML config `file` (default $CONFIG_FILE)")
+	for _, f := range configFlags {
+		fs.String(f.name, "", f.usage)
+	}
+}
+
+// initConfig loads the configuration, sets up logging and exits when any
+// setting is invalid. Flags must have been parsed.
+func initConfig() {
 	// Load .env file (looks in current dir and parent dir)
+	envLoaded := true
 	if err := godotenv.Load(); err != nil {
 		// Try parent directory (for when running from render-api folder)
 		if err := godotenv.Load("../.env"); err != nil {
-			log.Println("no .env file found, using environment variables")
+			envLoaded = false
 		}
 	}
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
 
-	// Set defaults
-	config.TemplatesDir = "../templates"
-	config.ServerAddr = ":8080"
+	cfg, errs := loadConfig()
+	setupLogging(cfg.Log)
+	if !envLoaded {
+		slog.Info("no .env file found, using environment variables")
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("invalid configuration", "error", err)
+		}
+		os.Exit(1)
+	}
+	config = cfg
+	setAllowedOrigins(config.AllowedOrigins)
+	setRedactionProfiles(config.RedactionProfiles)
 
-	// Load allowed origins
-	origins := os.Getenv("ALLOWED_ORIGINS")
-	if origins == "" {
-		config.AllowedOrigins = []string{}
+	if configFile != "" {
+		slog.Info("loaded config file", "path", configFile)
+	}
+	slog.Info("allowed CORS origins", "origins", config.AllowedOrigins)
+	if config.Browser.ChromePath != "" {
+		slog.Info("using chrome binary", "path", config.Browser.ChromePath)
+	}
+	slog.Info("chrome pool configured",
+		"size", config.Browser.PoolSize,
+		"max_renders", config.Browser.MaxRenders,
+		"health_interval", config.Browser.HealthInterval.String())
+	if config.RedactionProfilesFile != "" {
+		slog.Info("loaded redaction profiles", "count", len(config.RedactionProfiles), "path", config.RedactionProfilesFile)
+	}
+	if config.DMS.APIURL != "" {
+		slog.Info("DMS API configured", "url", config.DMS.APIURL)
 	} else {
-		for _, o := range strings.Split(origins, ",") {
-			o = strings.TrimSpace(o)
-			if o != "" {
-				config.AllowedOrigins = append(config.AllowedOrigins, o)
+		slog.Info("DMS API not configured (DMS_API_URL not set)")
+	}
+	if need := config.RateLimit.QueueTimeout + time.Minute; config.Server.WriteTimeout < need {
+		slog.Warn("server write timeout is shorter than a queued render may take, slow renders will be cut off",
+			"write_timeout", config.Server.WriteTimeout.String(), "recommended", need.String())
+	}
+}
+
+// loadConfig builds the configuration from defaults, the config file, the
+// environment and the command-line flags, and validates it. It returns every
+// problem found rather than only the first.
+func loadConfig() (Config, []error) {
+	return loadConfigLayers(flag.CommandLine)
+}
+
+// loadConfigLayers is loadConfig with the flags given on flags as the last layer
+func loadConfigLayers(flags *flag.FlagSet) (Config, []error) {
+	cfg := defaultConfig()
+	var errs []error
+
+	if configFile != "" {
+		if err := loadConfigFile(configFile, &cfg); err != nil {
+			return cfg, []error{err}
+		}
+	}
+
+	env := &envLoader{}
+	env.apply(&cfg)
+	errs = append(errs, env.errs...)
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, cf := range configFlags {
+			if cf.name == f.Name {
+				if err := cf.apply(&cfg, f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", f.Name, err))
+				}
 			}
 		}
+	})
+
+	cfg.normalize()
+	errs = append(errs, cfg.validate()...)
+
+	if cfg.RedactionProfilesFile != "" && len(errs) == 0 {
+		profiles, err := loadRedactionProfiles(cfg.RedactionProfilesFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("redaction_profiles_file: %w", err))
+		}
+		cfg.RedactionProfiles = profiles
+	}
+	return cfg, errs
+}
+
+// loadConfigFile decodes a YAML config file over cfg. Unknown keys are an
+// error so typos don't silently fall back to defaults.
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envLoader reads environment variables over the values of the earlier
+// layers. Only variables that are set and not empty override a setting, so
+// values from the config file keep their full precision. Invalid values are
+// collected rather than replaced by defaults.
+type envLoader struct {
+	errs []error
+}
+
+// apply reads every environment variable into cfg
+func (e *envLoader) apply(cfg *Config) {
+	e.list("ALLOWED_ORIGINS", &cfg.AllowedOrigins)
+
+	// Server
+	e.string("TEMPLATES_DIR", &cfg.TemplatesDir)
+	e.string("SERVER_ADDR", &cfg.Server.Addr)
+	e.string("METRICS_ADDR", &cfg.Server.MetricsAddr)
+	e.duration("HTTP_READ_HEADER_TIMEOUT_SECONDS", time.Second, &cfg.Server.ReadHeaderTimeout)
+	e.duration("HTTP_READ_TIMEOUT_SECONDS", time.Second, &cfg.Server.ReadTimeout)
+	e.duration("HTTP_WRITE_TIMEOUT_SECONDS", time.Second, &cfg.Server.WriteTimeout)
+	e.duration("HTTP_IDLE_TIMEOUT_SECONDS", time.Second, &cfg.Server.IdleTimeout)
+	e.megabytes("HTTP_MAX_BODY_MB", &cfg.Server.MaxBodyBytes)
+	e.duration("SHUTDOWN_TIMEOUT_SECONDS", time.Second, &cfg.Server.ShutdownTimeout)
+
+	// Logging and tracing
+	if v, ok := e.lookup("LOG_LEVEL"); ok {
+		if err := cfg.Log.Level.UnmarshalText([]byte(v)); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("LOG_LEVEL: %w", err))
+		}
 	}
-	log.Printf("allowed CORS origins: %v", config.AllowedOrigins)
+	e.string("LOG_FORMAT", &cfg.Log.Format)
+	e.string("OTEL_TRACES_EXPORTER", &cfg.Tracing.Exporter)
+	e.string("OTEL_SERVICE_NAME", &cfg.Tracing.ServiceName)
 
-	// Load DMS configuration
-	config.DMS.APIURL = os.Getenv("DMS_API_URL")
-	config.DMS.APISecret = os.Getenv("DMS_API_SECRET")
+	// DMS
+	e.string("DMS_API_URL", &cfg.DMS.APIURL)
+	e.string("DMS_API_SECRET", &cfg.DMS.APISecret)
+	e.duration("DMS_TIMEOUT_SECONDS", time.Second, &cfg.DMS.Timeout)
 
-	// Load Chrome/Chromium executable path
-	config.ChromePath = os.Getenv("CHROME_PATH")
-	if config.ChromePath == "" {
-		config.ChromePath = os.Getenv("CHROMEDP_EXEC_PATH")
+	// Chrome pool and PDF defaults
+	e.string("CHROMEDP_EXEC_PATH", &cfg.Browser.ChromePath)
+	e.string("CHROME_PATH", &cfg.Browser.ChromePath)
+	if v, ok := e.lookup("CHROME_FLAGS"); ok {
+		cfg.Browser.Flags = strings.Fields(v)
 	}
-	if config.ChromePath != "" {
-		log.Printf("using chrome binary: %s", config.ChromePath)
+	e.int("PDF_POOL_SIZE", &cfg.Browser.PoolSize)
+	e.int("PDF_POOL_MAX_RENDERS", &cfg.Browser.MaxRenders)
+	e.duration("PDF_POOL_HEALTH_INTERVAL", time.Second, &cfg.Browser.HealthInterval)
+	e.duration("PDF_WAIT_TIMEOUT_MS", time.Millisecond, &cfg.Browser.WaitTimeout)
+	e.duration("PDF_NETWORK_IDLE_MS", time.Millisecond, &cfg.Browser.NetworkIdle)
+	e.string("PDF_PAPER_SIZE", &cfg.PDF.PaperSize)
+	e.string("PDF_ORIENTATION", &cfg.PDF.Orientation)
+	if v, ok := e.lookup("PDF_MARGIN"); ok {
+		if err := cfg.PDF.Margin.UnmarshalText([]byte(v)); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("PDF_MARGIN: %w", err))
+		}
 	}
-	if config.DMS.APIURL != "" {
-		log.Printf("DMS API configured: %s", config.DMS.APIURL)
-	} else {
-		log.Println("DMS API not configured (DMS_API_URL not set)")
+
+	// Template cache
+	e.int("TEMPLATE_CACHE_SIZE", &cfg.TemplateCache.MaxEntries)
+	e.megabytes("TEMPLATE_CACHE_MAX_MB", &cfg.TemplateCache.MaxBytes)
+
+	// Async jobs and webhooks
+	e.int("JOB_WORKERS", &cfg.Jobs.Workers)
+	e.int("JOB_QUEUE_SIZE", &cfg.Jobs.QueueSize)
+	e.string("JOB_STORE", &cfg.Jobs.Store)
+	e.string("JOB_DIR", &cfg.Jobs.Dir)
+	e.duration("JOB_RESULT_TTL_HOURS", time.Hour, &cfg.Jobs.ResultTTL)
+	e.string("WEBHOOK_SECRET", &cfg.Webhook.Secret)
+	e.int("WEBHOOK_MAX_ATTEMPTS", &cfg.Webhook.MaxAttempts)
+	e.duration("WEBHOOK_BACKOFF_SECONDS", time.Second, &cfg.Webhook.InitialBackoff)
+	e.duration("WEBHOOK_MAX_BACKOFF_SECONDS", time.Second, &cfg.Webhook.MaxBackoff)
+	e.duration("WEBHOOK_TIMEOUT_SECONDS", time.Second, &cfg.Webhook.Timeout)
+	e.string("PUBLIC_BASE_URL", &cfg.Webhook.PublicBaseURL)
+
+	// Batch rendering
+	e.int("BATCH_MAX_ITEMS", &cfg.Batch.MaxItems)
+	e.int("BATCH_CONCURRENCY", &cfg.Batch.Concurrency)
+
+	// Image pre-fetch
+	e.bool("IMAGE_INLINE", &cfg.Images.Inline)
+	e.list("IMAGE_ALLOWED_HOSTS", &cfg.Images.AllowedHosts)
+	e.megabytes("IMAGE_MAX_MB", &cfg.Images.MaxBytes)
+	e.duration("IMAGE_FETCH_TIMEOUT_SECONDS", time.Second, &cfg.Images.FetchTimeout)
+	e.int("IMAGE_FETCH_CONCURRENCY", &cfg.Images.Concurrency)
+	e.int("IMAGE_MAX_DIMENSION", &cfg.Images.MaxDimension)
+	e.int("IMAGE_MAX_PIXELS", &cfg.Images.MaxPixels)
+	e.int("IMAGE_MAX_COUNT", &cfg.Images.MaxCount)
+	e.int("IMAGE_JPEG_QUALITY", &cfg.Images.JPEGQuality)
+	e.string("IMAGE_PLACEHOLDER", &cfg.Images.Placeholder)
+
+	// Outbound resource policy
+	e.list("RESOURCE_ALLOWED_SCHEMES", &cfg.Resources.AllowedSchemes)
+	e.list("RESOURCE_ALLOWED_HOSTS", &cfg.Resources.AllowedHosts)
+	var cidrs []string
+	if e.list("RESOURCE_ALLOWED_CIDRS", &cidrs) {
+		cfg.Resources.AllowedCIDRs = nil
+		for _, c := range cidrs {
+			var n CIDR
+			if err := n.UnmarshalText([]byte(c)); err != nil {
+				e.errs = append(e.errs, fmt.Errorf("RESOURCE_ALLOWED_CIDRS: %w", err))
+				continue
+			}
+			cfg.Resources.AllowedCIDRs = append(cfg.Resources.AllowedCIDRs, n)
+		}
+	}
+	e.bool("RESOURCE_BLOCK_PRIVATE", &cfg.Resources.BlockPrivate)
+	e.megabytes("RESOURCE_MAX_MB", &cfg.Resources.MaxBytes)
+	e.string("RESOURCE_ASSETS_DIR", &cfg.Resources.AssetsDir)
+
+	// Authentication
+	e.string("AUTH_CLIENTS_FILE", &cfg.Auth.ClientsFile)
+	e.string("AUTH_JWKS_FILE", &cfg.Auth.JWKSFile)
+	e.string("AUTH_JWT_ISSUER", &cfg.Auth.JWTIssuer)
+	e.string("AUTH_JWT_AUDIENCE", &cfg.Auth.JWTAudience)
+	e.duration("AUTH_HMAC_MAX_SKEW_SECONDS", time.Second, &cfg.Auth.HMACMaxSkew)
+
+	// Rate limits. RATE_LIMIT_ROUTES overrides the default per route as
+	// comma-separated route=rate:burst entries, e.g. /render/pdf=0.5:5
+	e.float("RATE_LIMIT_RPS", &cfg.RateLimit.Default.Rate)
+	e.int("RATE_LIMIT_BURST", &cfg.RateLimit.Default.Burst)
+	var routes []string
+	e.list("RATE_LIMIT_ROUTES", &routes)
+	for _, entry := range routes {
+		route, limit, err := parseRouteLimit(entry)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("RATE_LIMIT_ROUTES entry %q: %w", entry, err))
+			continue
+		}
+		if cfg.RateLimit.Routes == nil {
+			cfg.RateLimit.Routes = make(map[string]RouteLimit)
+		}
+		cfg.RateLimit.Routes[route] = limit
+	}
+	e.float("RATE_LIMIT_IP_RPS", &cfg.RateLimit.PerIP.Rate)
+	e.int("RATE_LIMIT_IP_BURST", &cfg.RateLimit.PerIP.Burst)
+	e.int("RENDER_MAX_CONCURRENT", &cfg.RateLimit.MaxConcurrent)
+	e.int("RENDER_MAX_QUEUE", &cfg.RateLimit.MaxQueue)
+	e.duration("RENDER_QUEUE_TIMEOUT_SECONDS", time.Second, &cfg.RateLimit.QueueTimeout)
+
+	// Readiness checks
+	e.duration("READY_CACHE_SECONDS", time.Second, &cfg.Health.CacheTTL)
+	e.duration("READY_CHECK_TIMEOUT_SECONDS", time.Second, &cfg.Health.CheckTimeout)
+	e.bool("READY_REQUIRE_DMS", &cfg.Health.RequireDMS)
+
+	e.string("REDACTION_PROFILES_FILE", &cfg.RedactionProfilesFile)
+}
+
+// lookup returns a trimmed environment variable, and whether it is set and
+// not empty
+func (e *envLoader) lookup(key string) (string, bool) {
+	v, ok := os.LookupEnv(key)
+	v = strings.TrimSpace(v)
+	return v, ok && v != ""
+}
+
+// string reads a string environment variable into dst
+func (e *envLoader) string(key string, dst *string) {
+	if v, ok := e.lookup(key); ok {
+		*dst = v
+	}
+}
+
+// list reads a comma-separated environment variable into dst, reporting
+// whether it was set
+func (e *envLoader) list(key string, dst *[]string) bool {
+	v, ok := e.lookup(key)
+	if !ok {
+		return false
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*dst = list
+	return true
+}
+
+// int reads a non-negative integer environment variable into dst
+func (e *envLoader) int(key string, dst *int) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not a non-negative integer", key, v))
+		return
+	}
+	*dst = n
+}
+
+// float reads a non-negative decimal environment variable into dst
+func (e *envLoader) float(key string, dst *float64) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not a non-negative number", key, v))
+		return
+	}
+	*dst = f
+}
+
+// bool reads a true/false environment variable into dst
+func (e *envLoader) bool(key string, dst *bool) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not true or false", key, v))
+		return
+	}
+	*dst = b
+}
+
+// duration reads a duration environment variable into dst: a bare number
+// counts in unit, the unit its name ends in, and a Go duration such as 1500ms
+// is taken as is
+func (e *envLoader) duration(key string, unit time.Duration, dst *time.Duration) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil && n >= 0 {
+		*dst = time.Duration(n * float64(unit))
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not a non-negative number or duration", key, v))
+		return
+	}
+	*dst = d
+}
+
+// megabytes reads a whole number of megabytes into dst as bytes
+func (e *envLoader) megabytes(key string, dst *int64) {
+	n := -1
+	if e.int(key, &n); n >= 0 {
+		*dst = int64(n) << 20
+	}
+}
+
+// normalize lowercases case-insensitive settings and fills in settings that
+// default to the Chrome pool size
+func (cfg *Config) normalize() {
+	lower := func(list []string) []string {
+		for i, v := range list {
+			list[i] = strings.ToLower(v)
+		}
+		return list
+	}
+	cfg.Images.AllowedHosts = lower(cfg.Images.AllowedHosts)
+	cfg.Resources.AllowedHosts = lower(cfg.Resources.AllowedHosts)
+	cfg.Resources.AllowedSchemes = lower(cfg.Resources.AllowedSchemes)
+	cfg.Log.Format = strings.ToLower(cfg.Log.Format)
+	cfg.Tracing.Exporter = strings.ToLower(cfg.Tracing.Exporter)
+	cfg.Jobs.Store = strings.ToLower(cfg.Jobs.Store)
+	cfg.PDF.Orientation = strings.ToLower(cfg.PDF.Orientation)
+	for i, f := range cfg.Browser.Flags {
+		cfg.Browser.Flags[i] = strings.TrimLeft(f, "-")
+	}
+
+	if cfg.Batch.Concurrency == 0 {
+		cfg.Batch.Concurrency = cfg.Browser.PoolSize
+	}
+	if cfg.RateLimit.MaxConcurrent == 0 {
+		cfg.RateLimit.MaxConcurrent = cfg.Browser.PoolSize
+	}
+}
+
+// validate checks the settings, naming each bad one by its config file key
+func (cfg *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	positive := func(d time.Duration, key string) {
+		check(d > 0, key, "must be positive")
+	}
+	atLeastOne := func(n int, key string) {
+		check(n >= 1, key, "must be at least 1")
+	}
+	addr := func(a, key string) {
+		_, _, err := net.SplitHostPort(a)
+		check(err == nil, key, "invalid address %q, want host:port or :port", a)
+	}
+	httpURL := func(s, key string) {
+		u, err := url.Parse(s)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", key, "invalid http(s) URL %q", s)
+	}
+	exists := func(path, key string) {
+		_, err := os.Stat(path)
+		check(err == nil, key, "%v", err)
+	}
+
+	// Server
+	addr(cfg.Server.Addr, "server.addr")
+	if cfg.Server.MetricsAddr != "" {
+		addr(cfg.Server.MetricsAddr, "server.metrics_addr")
+		check(cfg.Server.MetricsAddr != cfg.Server.Addr, "server.metrics_addr", "must differ from server.addr")
+	}
+	positive(cfg.Server.ReadHeaderTimeout, "server.read_header_timeout")
+	positive(cfg.Server.ReadTimeout, "server.read_timeout")
+	positive(cfg.Server.WriteTimeout, "server.write_timeout")
+	positive(cfg.Server.IdleTimeout, "server.idle_timeout")
+	positive(cfg.Server.ShutdownTimeout, "server.shutdown_timeout")
+	check(cfg.Server.MaxBodyBytes > 0, "server.max_body_bytes", "must be positive")
+	check(cfg.TemplatesDir != "", "templates_dir", "must be set")
+	for _, o := range cfg.AllowedOrigins {
+		httpURL(o, "allowed_origins")
+	}
+
+	// Chrome and PDF defaults
+	if cfg.Browser.ChromePath != "" {
+		_, err := exec.LookPath(cfg.Browser.ChromePath)
+		check(err == nil, "chrome.path", "%v", err)
+	}
+	for _, f := range cfg.Browser.Flags {
+		check(f != "" && !strings.HasPrefix(f, "="), "chrome.flags", "invalid flag %q", f)
+	}
+	atLeastOne(cfg.Browser.PoolSize, "chrome.pool_size")
+	positive(cfg.Browser.HealthInterval, "chrome.health_interval")
+	positive(cfg.Browser.WaitTimeout, "chrome.wait_timeout")
+	positive(cfg.Browser.NetworkIdle, "chrome.network_idle")
+	if cfg.PDF.PaperSize != "" {
+		_, ok := paperSizes[strings.ToUpper(cfg.PDF.PaperSize)]
+		check(ok, "pdf.paper_size", "unknown paper size %q (use A3, A4, A5, B5, F4, Letter, Legal or Tabloid)", cfg.PDF.PaperSize)
+	}
+	check(cfg.PDF.Orientation == "" || cfg.PDF.Orientation == "portrait" || cfg.PDF.Orientation == "landscape",
+		"pdf.orientation", "must be portrait or landscape")
+
+	// Caches, jobs and batches
+	atLeastOne(cfg.TemplateCache.MaxEntries, "template_cache.max_entries")
+	check(cfg.TemplateCache.MaxBytes > 0, "template_cache.max_bytes", "must be positive")
+	atLeastOne(cfg.Jobs.Workers, "jobs.workers")
+	atLeastOne(cfg.Jobs.QueueSize, "jobs.queue_size")
+	check(cfg.Jobs.Store == "memory" || cfg.Jobs.Store == "disk", "jobs.store", "must be memory or disk")
+	check(cfg.Jobs.Store != "disk" || cfg.Jobs.Dir != "", "jobs.dir", "must be set for the disk store")
+	positive(cfg.Jobs.ResultTTL, "jobs.result_ttl")
+	atLeastOne(cfg.Webhook.MaxAttempts, "webhooks.max_attempts")
+	positive(cfg.Webhook.InitialBackoff, "webhooks.initial_backoff")
+	check(cfg.Webhook.MaxBackoff >= cfg.Webhook.InitialBackoff, "webhooks.max_backoff", "must not be below webhooks.initial_backoff")
+	positive(cfg.Webhook.Timeout, "webhooks.timeout")
+	if cfg.Webhook.PublicBaseURL != "" {
+		httpURL(cfg.Webhook.PublicBaseURL, "webhooks.public_base_url")
+	}
+	atLeastOne(cfg.Batch.MaxItems, "batch.max_items")
+	atLeastOne(cfg.Batch.Concurrency, "batch.concurrency")
+
+	// Images and resource policy
+	check(cfg.Images.MaxBytes > 0, "images.max_bytes", "must be positive")
+	positive(cfg.Images.FetchTimeout, "images.fetch_timeout")
+	atLeastOne(cfg.Images.Concurrency, "images.concurrency")
+	check(cfg.Images.MaxPixels > 0, "images.max_pixels", "must be positive")
+	atLeastOne(cfg.Images.MaxCount, "images.max_count")
+	check(cfg.Images.JPEGQuality >= 1 && cfg.Images.JPEGQuality <= 100, "images.jpeg_quality", "must be between 1 and 100")
+	if cfg.Images.Placeholder != "" {
+		exists(cfg.Images.Placeholder, "images.placeholder")
+	}
+	check(len(cfg.Resources.AllowedSchemes) > 0, "resources.allowed_schemes", "must not be empty")
+	check(cfg.Resources.MaxBytes > 0, "resources.max_bytes", "must be positive")
+	if cfg.Resources.AssetsDir != "" {
+		exists(cfg.Resources.AssetsDir, "resources.assets_dir")
+	}
+
+	// Authentication
+	if cfg.Auth.ClientsFile != "" {
+		exists(cfg.Auth.ClientsFile, "auth.clients_file")
+	}
+	if cfg.Auth.JWKSFile != "" {
+		exists(cfg.Auth.JWKSFile, "auth.jwks_file")
+	}
+	positive(cfg.Auth.HMACMaxSkew, "auth.hmac_max_skew")
+
+	// Logging and tracing
+	check(cfg.Log.Format == "text" || cfg.Log.Format == "json", "log.format", "must be text or json")
+	switch cfg.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		check(false, "tracing.exporter", "must be otlp, stdout or none")
+	}
+
+	// Rate limits
+	check(cfg.RateLimit.Default.Rate >= 0, "rate_limit.default.rate", "must not be negative")
+	atLeastOne(cfg.RateLimit.Default.Burst, "rate_limit.default.burst")
+	for route, limit := range cfg.RateLimit.Routes {
+		check(strings.HasPrefix(route, "/"), "rate_limit.routes", "route %q must start with /", route)
+		check(limit.Rate >= 0, "rate_limit.routes."+route+".rate", "must not be negative")
+		atLeastOne(limit.Burst, "rate_limit.routes."+route+".burst")
+	}
+	check(cfg.RateLimit.PerIP.Rate >= 0, "rate_limit.per_ip.rate", "must not be negative")
+	atLeastOne(cfg.RateLimit.PerIP.Burst, "rate_limit.per_ip.burst")
+	atLeastOne(cfg.RateLimit.MaxConcurrent, "rate_limit.max_concurrent")
+	check(cfg.RateLimit.MaxQueue >= 0, "rate_limit.max_queue", "must not be negative")
+	positive(cfg.RateLimit.QueueTimeout, "rate_limit.queue_timeout")
+
+	// Readiness and DMS
+	positive(cfg.Health.CacheTTL, "health.cache_ttl")
+	positive(cfg.Health.CheckTimeout, "health.check_timeout")
+	if cfg.DMS.APIURL != "" {
+		httpURL(cfg.DMS.APIURL, "dms.api_url")
+	}
+	check(!cfg.Health.RequireDMS || cfg.DMS.APIURL != "", "health.require_dms", "needs dms.api_url")
+	positive(cfg.DMS.Timeout, "dms.timeout")
+
+	return errs
+}
+
+// loadRedactionProfiles reads named redaction profiles from a JSON file
+func loadRedactionProfiles(path string) (map[string]*RedactionProfile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*RedactionProfile
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid json in %s: %w", path, err)
+	}
+	for name, p := range profiles {
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return profiles, nil
+}
+
+// parseRouteLimit parses a route=rate:burst rate limit entry
+func parseRouteLimit(entry string) (string, RouteLimit, error) {
+	route, spec, ok := strings.Cut(entry, "=")
+	if !ok || route == "" {
+		return "", RouteLimit{}, fmt.Errorf("expected route=rate:burst")
+	}
+	rate, burst, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", RouteLimit{}, fmt.Errorf("expected route=rate:burst")
+	}
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r < 0 {
+		return "", RouteLimit{}, fmt.Errorf("invalid rate %q", rate)
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 1 {
+		return "", RouteLimit{}, fmt.Errorf("invalid burst %q", burst)
 	}
+	return route, RouteLimit{Rate: r, Burst: b}, nil
 }
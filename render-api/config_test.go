@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads the configuration from a YAML file with the given
+// content, if any, and the given command-line flags
+func loadTestConfig(t *testing.T, yaml string, args ...string) (Config, []error) {
+	t.Helper()
+
+	prev := configFile
+	t.Cleanup(func() { configFile = prev })
+	configFile = ""
+
+	flags := flag.NewFlagSet("render-api", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	if yaml != "" {
+		configFile = filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(configFile, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return loadConfigLayers(flags)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, errs := loadTestConfig(t, "")
+	if len(errs) > 0 {
+		t.Fatalf("defaults don't validate: %v", errs)
+	}
+
+	want := defaultConfig()
+	if cfg.Server.Addr != want.Server.Addr {
+		t.Errorf("server.addr = %q, want %q", cfg.Server.Addr, want.Server.Addr)
+	}
+	if cfg.Webhook.InitialBackoff != want.Webhook.InitialBackoff {
+		t.Errorf("webhooks.initial_backoff = %v, want %v", cfg.Webhook.InitialBackoff, want.Webhook.InitialBackoff)
+	}
+	if cfg.RateLimit.MaxConcurrent != cfg.Browser.PoolSize {
+		t.Errorf("rate_limit.max_concurrent = %d, want the pool size %d", cfg.RateLimit.MaxConcurrent, cfg.Browser.PoolSize)
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	yaml := `
+server:
+  addr: ":7000"
+  metrics_addr: ":7100"
+  read_header_timeout: 1500ms
+  read_timeout: 45s
+webhooks:
+  initial_backoff: 500ms
+  timeout: 3s
+jobs:
+  result_ttl: 30m
+template_cache:
+  max_bytes: 500000
+log:
+  level: warn
+`
+	t.Setenv("SERVER_ADDR", ":7001")
+	t.Setenv("HTTP_READ_TIMEOUT_SECONDS", "50")
+	t.Setenv("WEBHOOK_TIMEOUT_SECONDS", "2500ms")
+	t.Setenv("LOG_LEVEL", "error")
+
+	cfg, errs := loadTestConfig(t, yaml, "-addr", ":7002")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	tests := []struct {
+		name      string
+		got, want any
+	}{
+		// Flags override the environment and the file
+		{"server.addr", cfg.Server.Addr, ":7002"},
+		// The environment overrides the file
+		{"server.read_timeout", cfg.Server.ReadTimeout, 50 * time.Second},
+		{"webhooks.timeout", cfg.Webhook.Timeout, 2500 * time.Millisecond},
+		{"log.level", cfg.Log.Level, slog.LevelError},
+		// File values without an environment variable keep their precision
+		{"server.metrics_addr", cfg.Server.MetricsAddr, ":7100"},
+		{"server.read_header_timeout", cfg.Server.ReadHeaderTimeout, 1500 * time.Millisecond},
+		{"webhooks.initial_backoff", cfg.Webhook.InitialBackoff, 500 * time.Millisecond},
+		{"jobs.result_ttl", cfg.Jobs.ResultTTL, 30 * time.Minute},
+		{"template_cache.max_bytes", cfg.TemplateCache.MaxBytes, int64(500000)},
+		// Anything not set anywhere keeps its default
+		{"server.write_timeout", cfg.Server.WriteTimeout, defaultConfig().Server.WriteTimeout},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Setenv("JOB_WORKERS", "many")
+	t.Setenv("WEBHOOK_BACKOFF_SECONDS", "soon")
+
+	_, errs := loadTestConfig(t, "server:\n  addr: \":7000\"\n  read_timeout: 0s\n")
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	got := strings.Join(msgs, "\n")
+	for _, want := range []string{"JOB_WORKERS", "WEBHOOK_BACKOFF_SECONDS", "server.read_timeout: must be positive"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("errors don't mention %q:\n%s", want, got)
+		}
+	}
+
+	if _, errs := loadTestConfig(t, "server:\n  adr: \":7000\"\n"); len(errs) != 1 || !strings.Contains(errs[0].Error(), "adr") {
+		t.Errorf("unknown key: got %v, want one error naming it", errs)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines 1..n, one per line, with some of them replaced
+func numbered(n int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = strconv.Itoa(i)
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"from empty", "", "x\ny\n", "@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{"to empty", "x\ny\n", "", "@@ -1,2 +0,0 @@\n-x\n-y\n"},
+		{"single line to empty", "x\n", "", "@@ -1 +0,0 @@\n-x\n"},
+		{"removed line", "a\nb\nc\n", "a\nc\n", "@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"added line", "a\nc\n", "a\nb\nc\n", "@@ -1,2 +1,3 @@\n a\n+b\n c\n"},
+		{
+			"old side without trailing newline",
+			"a\nb", "a\nc\n",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n",
+		},
+		{
+			"trailing newline removed",
+			"a\nb\n", "a\nb",
+			"@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			// Six unchanged lines between changes fit in the shared context
+			"nearby changes share a hunk",
+			numbered(20, nil), numbered(20, map[int]string{5: "five", 12: "twelve"}),
+			"@@ -2,14 +2,14 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n 9\n 10\n 11\n-12\n+twelve\n 13\n 14\n 15\n",
+		},
+		{
+			"distant changes get their own hunks",
+			numbered(20, nil), numbered(20, map[int]string{5: "five", 13: "thirteen"}),
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n" +
+				"@@ -10,7 +10,7 @@\n 10\n 11\n 12\n-13\n+thirteen\n 14\n 15\n 16\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("offer-v1.html", "offer-v2.html", tt.a, tt.b)
+			if tt.want != "" {
+				tt.want = "--- offer-v1.html\n+++ offer-v2.html\n" + tt.want
+			}
+			if got != tt.want {
+				t.Errorf("diff:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesShortest(t *testing.T) {
+	a := splitLines("a\nb\nc\na\nb\nb\na\n")
+	b := splitLines("c\nb\na\nb\na\nc\n")
+	edits := 0
+	for _, op := range diffLines(a, b) {
+		if op.kind != ' ' {
+			edits++
+		}
+	}
+	// The classic example from Myers' paper has an edit distance of 5
+	if edits != 5 {
+		t.Errorf("%d edits, want 5", edits)
+	}
+}
+
+func TestDiffMaxEditsFallback(t *testing.T) {
+	// Shared first and last lines around two blocks with nothing in common,
+	// more edits apart than the search allows
+	n := maxDiffEdits/2 + 1
+	var a, b strings.Builder
+	a.WriteString("<html>\n")
+	b.WriteString("<html>\n")
+	for i := range n {
+		fmt.Fprintf(&a, "old %d\n", i)
+		fmt.Fprintf(&b, "new %d\n", i)
+	}
+	a.WriteString("</html>\n")
+	b.WriteString("</html>\n")
+
+	ops := diffLines(splitLines(a.String()), splitLines(b.String()))
+	if len(ops) != 2*n+2 {
+		t.Fatalf("%d ops, want %d", len(ops), 2*n+2)
+	}
+	if ops[0] != (diffOp{' ', "<html>\n"}) || ops[len(ops)-1] != (diffOp{' ', "</html>\n"}) {
+		t.Errorf("shared lines not kept: %q ... %q", ops[0].line, ops[len(ops)-1].line)
+	}
+	for i, op := range ops[1 : len(ops)-1] {
+		want := diffOp{'-', fmt.Sprintf("old %d\n", i)}
+		if i >= n {
+			want = diffOp{'+', fmt.Sprintf("new %d\n", i-n)}
+		}
+		if op != want {
+			t.Fatalf("op %d = %c%q, want the old block removed then the new one added", i, op.kind, op.line)
+		}
+	}
+
+	diff := unifiedDiff("a", "b", a.String(), b.String())
+	if want := fmt.Sprintf("@@ -1,%d +1,%d @@\n", n+2, n+2); !strings.HasPrefix(diff, "--- a\n+++ b\n"+want) {
+		t.Errorf("hunk header = %q, want %q", strings.SplitN(diff, "\n", 4)[2], want)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// renderOrigin is the origin rendered pages are served from inside Chrome. The
+// .invalid TLD never resolves, so only the request interceptor can answer it.
+// Pages on an http origin can't load file:// URLs, which keeps local files out
+// of reach; the assets directory is served under /assets/ instead.
+const renderOrigin = "http://render.invalid"
+
+// assetsPrefix is the path the assets directory is served under
+const assetsPrefix = "/assets/"
+
+// blockedRanges are the private, loopback, link-local (including cloud
+// metadata endpoints) and other non-public address ranges
+var blockedRanges = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+	"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// errBlocked wraps every policy violation
+var errBlocked = errors.New("blocked")
+
+// policy is the shared outbound resource policy
+var policy *resourcePolicy
+
+// resourcePolicy decides which URLs rendered pages and the image pre-fetcher may load
+type resourcePolicy struct {
+	cfg       ResourcePolicyConfig
+	assetsDir string // absolute, symlinks resolved; empty when no assets directory is set
+	resolver  *net.Resolver
+	pages     *http.Client // downloads what rendered pages load
+}
+
+// pageDialTimeout bounds connecting to a host a rendered page loads from;
+// the render deadline bounds the rest of the download
+const pageDialTimeout = 10 * time.Second
+
+// newResourcePolicy creates the policy from config
+func newResourcePolicy(cfg ResourcePolicyConfig) (*resourcePolicy, error) {
+	p := &resourcePolicy{cfg: cfg, resolver: net.DefaultResolver}
+	p.pages = &http.Client{
+		Transport: p.transport(pageDialTimeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if cfg.AssetsDir != "" {
+		dir, err := filepath.Abs(cfg.AssetsDir)
+		if err == nil {
+			dir, err = filepath.EvalSymlinks(dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid assets directory: %w", err)
+		}
+		p.assetsDir = dir
+	}
+	return p, nil
+}
+
+// blockedError reports a URL that the policy doesn't allow
+func blockedError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errBlocked, fmt.Sprintf(format, args...))
+}
+
+// checkURL returns an error if a page may not load rawURL
+func (p *resourcePolicy) checkURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return blockedError("invalid URL")
+	}
+	if u.Scheme == "file" {
+		return blockedError("file access outside RESOURCE_ASSETS_DIR")
+	}
+	if !slices.Contains(p.cfg.AllowedSchemes, u.Scheme) {
+		return blockedError("scheme %s is not allowed", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if len(p.cfg.AllowedHosts) > 0 && !hostMatches(host, p.cfg.AllowedHosts) {
+		return blockedError("host %s is not in RESOURCE_ALLOWED_HOSTS", host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return blockedError("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if err := p.checkIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIP returns an error for addresses in a blocked range that isn't explicitly allowed
+func (p *resourcePolicy) checkIP(ip net.IP) error {
+	for _, n := range p.cfg.AllowedCIDRs {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if p.cfg.BlockPrivate {
+		for _, n := range blockedRanges {
+			if n.Contains(ip) {
+				return blockedError("address %s is in a private or reserved range", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// dialControl rejects connections to blocked addresses. Checking at dial time
+// also covers redirects and DNS answers that change between lookups.
+func (p *resourcePolicy) dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return blockedError("cannot parse address %s", host)
+	}
+	return p.checkIP(ip)
+}
+
+// transport returns an HTTP transport that only connects to addresses the
+// policy allows. It ignores proxy settings, which would hide the address.
+func (p *resourcePolicy) transport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout, Control: p.dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return transport
+}
+
+// httpClient returns a client for server-side downloads that obeys the policy
+func (p *resourcePolicy) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: p.transport(timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !slices.Contains(p.cfg.AllowedSchemes, req.URL.Scheme) {
+				return blockedError("scheme %s is not allowed", req.URL.Scheme)
+			}
+			if len(p.cfg.AllowedHosts) > 0 && !hostMatches(req.URL.Hostname(), p.cfg.AllowedHosts) {
+				return blockedError("host %s is not in RESOURCE_ALLOWED_HOSTS", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// assetPath maps a file:// URL or an /assets/ path to a file in the assets
+// directory, reporting false if it lies outside it
+func (p *resourcePolicy) assetPath(path string) (string, bool) {
+	if p.assetsDir == "" {
+		return "", false
+	}
+	if rel, ok := strings.CutPrefix(path, assetsPrefix); ok {
+		path = filepath.Join(p.assetsDir, filepath.FromSlash(rel))
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(p.assetsDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return resolved, true
+}
+
+// assetURL rewrites a file:// URL inside the assets directory to the path it
+// is served at in rendered pages
+func (p *resourcePolicy) assetURL(fileURL string) (string, bool) {
+	u, err := url.Parse(fileURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	path, ok := p.assetPath(u.Path)
+	if !ok {
+		return "", false
+	}
+	rel, _ := filepath.Rel(p.assetsDir, path)
+	return assetsPrefix + filepath.ToSlash(rel), true
+}
+
+// fileURLErrors reports the file:// URLs in a payload that point outside the
+// assets directory; they are not marked safe and won't load
+func (p *resourcePolicy) fileURLErrors(data map[string]interface{}) []ResourceError {
+	var errs []ResourceError
+	walkStrings(data, func(s string) {
+		if strings.HasPrefix(s, "file://") {
+			if _, ok := p.assetURL(s); !ok {
+				errs = append(errs, ResourceError{URL: displayURL(s), Error: "blocked: file access outside RESOURCE_ASSETS_DIR"})
+			}
+		}
+	})
+	return errs
+}
+
+// intercept serves html as pageURL and applies the policy to every other
+// request the page makes, recording blocked requests on the watcher
+func (p *resourcePolicy) intercept(ctx context.Context, pageURL, html string, w *pageWatcher) chromedp.Action {
+	chromedp.ListenTarget(ctx, func(ev any) {
+		if e, ok := ev.(*fetch.EventRequestPaused); ok {
+			// CDP calls can't be made from the event handler itself
+			go p.handle(ctx, e, pageURL, html, w)
+		}
+	})
+	return fetch.Enable().WithPatterns([]*fetch.RequestPattern{
+		{URLPattern: "*", RequestStage: fetch.RequestStageRequest},
+	})
+}
+
+// handle serves the page and assets, and fetches every other request the
+// policy allows itself. Chrome never connects anywhere: the address a
+// resource loads from is the one dialControl checked, even if DNS answers
+// differently between the check and the download.
+func (p *resourcePolicy) handle(ctx context.Context, e *fetch.EventRequestPaused, pageURL, html string, w *pageWatcher) {
+	ctx = cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target)
+
+	var err error
+	reqURL := e.Request.URL
+	switch rest, local := strings.CutPrefix(reqURL, renderOrigin); {
+	case reqURL == pageURL:
+		err = fulfill(ctx, e.RequestID, http.StatusOK, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, []byte(html))
+	case local:
+		err = p.serveAsset(ctx, e, rest)
+	default:
+		err = p.forward(ctx, e, w)
+	}
+	if err != nil && ctx.Err() == nil {
+		slog.WarnContext(ctx, "request interception failed", "url", displayURL(reqURL), "error", err)
+	}
+}
+
+// serveAsset answers a request on the render origin from the assets directory
+func (p *resourcePolicy) serveAsset(ctx context.Context, e *fetch.EventRequestPaused, rest string) error {
+	if u, err := url.Parse(rest); err == nil {
+		if path, ok := p.assetPath(u.Path); ok {
+			if content, err := os.ReadFile(path); err == nil {
+				return fulfill(ctx, e.RequestID, http.StatusOK, http.Header{"Content-Type": {mime.TypeByExtension(filepath.Ext(path))}}, content)
+			}
+		}
+	}
+	return fetch.FulfillRequest(e.RequestID, http.StatusNotFound).Do(ctx)
+}
+
+// forward downloads a request the page makes through the policy's client and
+// answers Chrome with the response. Redirects go back to Chrome, which asks
+// for the new location as a fresh, checked request. Bodies are read up to
+// the configured maximum and larger responses are blocked.
+func (p *resourcePolicy) forward(ctx context.Context, e *fetch.EventRequestPaused, w *pageWatcher) error {
+	if err := p.checkURL(ctx, e.Request.URL); err != nil {
+		return p.block(ctx, e, err, w)
+	}
+
+	req, err := pageRequest(ctx, e.Request)
+	if err != nil {
+		return p.block(ctx, e, blockedError("invalid request: %v", err), w)
+	}
+	resp, err := p.pages.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlocked) {
+			return p.block(ctx, e, err, w)
+		}
+		return fetch.FailRequest(e.RequestID, network.ErrorReasonFailed).Do(ctx)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > p.cfg.MaxBytes {
+		return p.block(ctx, e, blockedError("response is larger than %d bytes", p.cfg.MaxBytes), w)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.cfg.MaxBytes+1))
+	if err != nil {
+		return fetch.FailRequest(e.RequestID, network.ErrorReasonFailed).Do(ctx)
+	}
+	if int64(len(body)) > p.cfg.MaxBytes {
+		return p.block(ctx, e, blockedError("response is larger than %d bytes", p.cfg.MaxBytes), w)
+	}
+	return fulfill(ctx, e.RequestID, resp.StatusCode, resp.Header, body)
+}
+
+// pageRequest rebuilds the HTTP request Chrome paused. Accept-Encoding is
+// left to the transport, which decodes the body before Chrome gets it.
+func pageRequest(ctx context.Context, r *network.Request) (*http.Request, error) {
+	var body []byte
+	for _, entry := range r.PostDataEntries {
+		b, err := base64.StdEncoding.DecodeString(entry.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, b...)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.Headers {
+		if v, ok := value.(string); ok && !strings.EqualFold(name, "Accept-Encoding") {
+			req.Header.Set(name, v)
+		}
+	}
+	return req, nil
+}
+
+// block fails a paused request and reports it
+func (p *resourcePolicy) block(ctx context.Context, e *fetch.EventRequestPaused, reason error, w *pageWatcher) error {
+	slog.WarnContext(ctx, "blocked resource", "url", displayURL(e.Request.URL), "reason", reason)
+	w.record(e.Request.URL, reason.Error())
+	return fetch.FailRequest(e.RequestID, network.ErrorReasonBlockedByClient).Do(ctx)
+}
+
+// fulfill answers a paused request. The body is already decoded, so the
+// headers describing its transfer encoding are dropped.
+func fulfill(ctx context.Context, id fetch.RequestID, status int, header http.Header, body []byte) error {
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+	var headers []*fetch.HeaderEntry
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Encoding", "Content-Length", "Transfer-Encoding", "Connection":
+			continue
+		}
+		for _, v := range values {
+			headers = append(headers, &fetch.HeaderEntry{Name: name, Value: v})
+		}
+	}
+	return fetch.FulfillRequest(id, int64(status)).
+		WithResponseHeaders(headers).
+		WithBody(base64.StdEncoding.EncodeToString(body)).
+		Do(ctx)
+}
+
+// hostMatches reports whether host is one of patterns; "*.example.com"
+// matches any subdomain of example.com
+func hostMatches(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a fixed list of CIDRs
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
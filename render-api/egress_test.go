@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckIP(t *testing.T) {
+	p := &resourcePolicy{cfg: ResourcePolicyConfig{
+		BlockPrivate: true,
+		AllowedCIDRs: []CIDR{{parseCIDRs("10.20.0.0/16")[0]}},
+	}}
+	for addr, ok := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"10.20.1.2":        true, // allowed range
+		"10.21.1.2":        false,
+		"127.0.0.1":        false,
+		"169.254.169.254":  false,
+		"192.168.1.1":      false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+	} {
+		if err := p.checkIP(net.ParseIP(addr)); (err == nil) != ok {
+			t.Errorf("checkIP(%s) = %v, want ok %v", addr, err, ok)
+		}
+	}
+
+	open := &resourcePolicy{}
+	if err := open.checkIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("checkIP without block_private = %v", err)
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	patterns := []string{"cdn.example.com", "*.googleapis.com"}
+	for host, want := range map[string]bool{
+		"cdn.example.com":          true,
+		"CDN.Example.com":          true,
+		"fonts.googleapis.com":     true,
+		"a.b.googleapis.com":       true,
+		"googleapis.com":           false,
+		"evilgoogleapis.com":       false,
+		"example.com":              false,
+		"cdn.example.com.evil.net": false,
+	} {
+		if got := hostMatches(host, patterns); got != want {
+			t.Errorf("hostMatches(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	p := &resourcePolicy{
+		cfg:      ResourcePolicyConfig{AllowedSchemes: []string{"http", "https"}, BlockPrivate: true},
+		resolver: net.DefaultResolver,
+	}
+	for raw, ok := range map[string]bool{
+		"https://93.184.216.34/logo.png": true,
+		"http://127.0.0.1:8080/":         false,
+		"http://[::1]/":                  false,
+		"http://localhost/":              false,
+		"file:///etc/passwd":             false,
+		"ftp://93.184.216.34/logo.png":   false,
+	} {
+		if err := p.checkURL(context.Background(), raw); (err == nil) != ok {
+			t.Errorf("checkURL(%q) = %v, want ok %v", raw, err, ok)
+		}
+	}
+
+	p.cfg.AllowedHosts = []string{"*.example.com"}
+	if err := p.checkURL(context.Background(), "https://93.184.216.34/"); !errors.Is(err, errBlocked) {
+		t.Errorf("host outside allowed_hosts: got %v", err)
+	}
+}
+
+// The page client checks the address it actually connects to, so a host
+// that passed checkURL and then resolves somewhere private is still refused
+func TestPageClientChecksDialedAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	p, err := newResourcePolicy(ResourcePolicyConfig{AllowedSchemes: []string{"http"}, BlockPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.pages.Get(srv.URL); !errors.Is(err, errBlocked) {
+		t.Errorf("page client reached %s: %v", srv.URL, err)
+	}
+
+	// Redirects are handed back to Chrome instead of being followed
+	redirect := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest", http.StatusFound))
+	defer redirect.Close()
+	p.cfg.AllowedCIDRs = []CIDR{{parseCIDRs("127.0.0.0/8")[0]}}
+	resp, err := p.pages.Get(redirect.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want the redirect itself", resp.StatusCode)
+	}
+}
+
+func TestAssetPath(t *testing.T) {
+	root := t.TempDir()
+	assets := filepath.Join(root, "assets")
+	for _, dir := range []string{filepath.Join(assets, "img"), filepath.Join(root, "secret")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(assets, "img", "logo.png"), filepath.Join(root, "secret", "key.pem"), filepath.Join(root, "config.yaml")} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"keys":      filepath.Join(root, "secret"),
+		"config":    filepath.Join(root, "config.yaml"),
+		"logo-link": filepath.Join(assets, "img", "logo.png"),
+	} {
+		if err := os.Symlink(target, filepath.Join(assets, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := newResourcePolicy(ResourcePolicyConfig{AssetsDir: assets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logo := filepath.Join(p.assetsDir, "img", "logo.png")
+	for path, want := range map[string]string{
+		"/assets/img/logo.png":                     logo,
+		"/assets/img/../img/logo.png":              logo,
+		"/assets/logo-link":                        logo,
+		filepath.Join(assets, "img/logo.png"):      logo,
+		"/assets/../config.yaml":                   "",
+		"/assets/../../etc/passwd":                 "",
+		"/assets/img/../../secret/key.pem":         "",
+		"/assets/keys/key.pem":                     "", // symlinked directory outside
+		"/assets/config":                           "", // symlinked file outside
+		"/assets/missing.png":                      "",
+		filepath.Join(root, "config.yaml"):         "",
+		filepath.Join(assets, "../secret/key.pem"): "",
+	} {
+		got, ok := p.assetPath(path)
+		if got != want || ok != (want != "") {
+			t.Errorf("assetPath(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+
+	if u, ok := p.assetURL("file://" + filepath.Join(assets, "img", "logo.png")); !ok || u != "/assets/img/logo.png" {
+		t.Errorf("assetURL = %q, %v", u, ok)
+	}
+	if _, ok := p.assetURL("file://" + filepath.Join(root, "config.yaml")); ok {
+		t.Error("assetURL accepted a file outside the assets directory")
+	}
+	if _, ok := (&resourcePolicy{}).assetPath("/assets/img/logo.png"); ok {
+		t.Error("assetPath served a file with no assets directory configured")
+	}
+}
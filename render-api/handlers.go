@@ -2,15 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"regexp"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -33,6 +35,37 @@ var templateFuncMap = template.FuncMap{
 		}
 		return a / b
 	},
+	// Float math on numbers or numeric strings
+	"addf": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"subf": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mulf": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"divf":  divideFloat,
+	"round": roundTo,
+	// Indonesian locale formatting
+	"rupiah":       formatRupiah,
+	"formatNumber": formatNumberID,
+	"terbilang":    terbilang,
+	"formatDate":   formatDateID,
+	"formatNPWP":   formatNPWP,
+	"formatPhone":  formatPhoneID,
+	// PII masking
+	"maskNIK":   maskFunc(maskNIKString),
+	"maskNPWP":  maskFunc(maskNPWPString),
+	"maskPhone": maskFunc(maskPhoneString),
+	"maskEmail": maskFunc(maskEmailString),
+	"maskName":  maskFunc(maskNameString),
+	// PDF header and footer placeholders, filled in by Chrome on every page
+	"pageNumber":    func() template.HTML { return pageNumberSpan },
+	"totalPages":    func() template.HTML { return totalPagesSpan },
+	"documentTitle": func() template.HTML { return documentTitleSpan },
+	// Render timestamp, e.g. {{formatDate now "2 January 2006 15:04"}}
+	"now": time.Now,
 }
 
 // handleRenderHTML handles POST /render/html - renders a Go template with data
@@ -50,34 +83,19 @@ func handleRenderHTML(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "invalid json: " + err.Error()})
-		return
-	}
-
-	if req.Template == "" {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template is required"})
+		writeJSON(w, decodeStatus(err), RenderResponse{Error: "invalid json: " + err.Error()})
 		return
 	}
-	if req.Data == nil {
-		req.Data = map[string]interface{}{}
-	}
 
-	// Auto-convert URL-like strings to safe URLs (for base64 images, etc.)
-	safeData := sanitizeDataForTemplate(req.Data)
-
-	tmpl, err := template.New("preview").Funcs(templateFuncMap).Option("missingkey=default").Parse(req.Template)
+	out, err := renderHTML(r.Context(), req.renderInput())
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template parse error: " + err.Error()})
-		return
-	}
-
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, safeData); err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template execute error: " + err.Error()})
+		writeRenderError(w, err)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, RenderResponse{HTML: buf.String()})
+	resp := out.response()
+	resp.HTML = out.HTML
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // handleSaveTemplate handles POST /templates/save - saves a template to disk
@@ -89,7 +107,7 @@ func handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
 
 	var req SaveRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, SaveResponse{Error: "invalid json: " + err.Error()})
+		writeJSON(w, decodeStatus(err), SaveResponse{Error: "invalid json: " + err.Error()})
 		return
 	}
 
@@ -107,27 +125,64 @@ func handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, SaveResponse{Error: "invalid name"})
 		return
 	}
+	if req.Schema != "" {
+		if _, err := parseSchema([]byte(req.Schema)); err != nil {
+			writeJSON(w, http.StatusBadRequest, SaveResponse{Error: err.Error()})
+			return
+		}
+	}
+	switch req.Status {
+	case "":
+		req.Status = StatusDraft
+	case StatusDraft, StatusApproved:
+	case StatusPublished:
+		writeJSON(w, http.StatusBadRequest, SaveResponse{Error: "status: save the version, then publish it with POST /templates/{name}/versions/{v}/publish"})
+		return
+	default:
+		writeJSON(w, http.StatusBadRequest, SaveResponse{Error: fmt.Sprintf("status: must be %s or %s", StatusDraft, StatusApproved)})
+		return
+	}
+	if req.Author == "" {
+		if client := clientFromContext(r.Context()); client != nil {
+			req.Author = client.ID
+		}
+	}
 
-	version := getNextVersion(safeName)
-	filename := fmt.Sprintf("%s-v%d.html", safeName, version)
-
-	if err := saveFile(filename, []byte(req.Template)); err != nil {
+	meta, err := newTemplateMeta([]byte(req.Template), req.Author, req.Message, req.Tags, req.Status).encode()
+	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, SaveResponse{Error: err.Error()})
 		return
 	}
 
-	// Optionally save the JSON data alongside
+	// The template is stored together with its metadata and optional data
+	// and schema sidecars, or not at all
+	files := [][]byte{[]byte(req.Template), nil, nil, meta}
 	if req.Data != "" {
-		dataFilename := fmt.Sprintf("%s-v%d.json", safeName, version)
-		if err := saveFile(dataFilename, []byte(req.Data)); err != nil {
-			log.Printf("warning: failed to save data file: %v", err)
-		}
+		files[1] = []byte(req.Data)
+	}
+	if req.Schema != "" {
+		files[2] = []byte(req.Schema)
+	}
+
+	version, err := saveTemplateVersion(safeName, files)
+	if err != nil {
+		writeJSON(w, saveErrorStatus(err), SaveResponse{Error: err.Error()})
+		return
 	}
+	filename := templateFilename(safeName, version)
 
-	log.Printf("saved template: %s (version %d)", filename, version)
+	slog.InfoContext(r.Context(), "saved template", "file", filename, "version", version)
 	writeJSON(w, http.StatusOK, SaveResponse{Filename: filename, Version: version})
 }
 
+// saveErrorStatus maps a failure to store a template version to a status code
+func saveErrorStatus(err error) int {
+	if errors.Is(err, errVersionConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 // handleListTemplates handles GET /templates/list - lists all templates
 func handleListTemplates(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -145,30 +200,49 @@ func handleListTemplates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var templates []TemplateInfo
-	versionPattern := regexp.MustCompile(`^(.+)-v(\d+)\.html$`)
+	query := r.URL.Query()
+	found := templateInfos(entries, false)
 
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".html") {
-			continue
+	// Archived versions are only listed on request
+	if archived, _ := strconv.ParseBool(query.Get("archived")); archived {
+		entries, err := os.ReadDir(filepath.Join(config.TemplatesDir, archiveDir))
+		if err != nil && !os.IsNotExist(err) {
+			writeJSON(w, http.StatusInternalServerError, ListResponse{Error: "failed to read template archive"})
+			return
 		}
+		found = append(found, templateInfos(entries, true)...)
+	}
 
-		matches := versionPattern.FindStringSubmatch(entry.Name())
-		if matches != nil {
-			version, _ := strconv.Atoi(matches[2])
-			templates = append(templates, TemplateInfo{
-				Name:     matches[1],
-				Filename: entry.Name(),
-				Version:  version,
-			})
-		} else {
-			name := strings.TrimSuffix(entry.Name(), ".html")
-			templates = append(templates, TemplateInfo{
-				Name:     name,
-				Filename: entry.Name(),
-				Version:  0,
-			})
+	// Filter by name, status and tags. Versions saved before metadata was
+	// recorded have no status or tags, so they only match a name filter.
+	name, status, tags := sanitizeName(query.Get("name")), query.Get("status"), query["tag"]
+	templates := []TemplateInfo{}
+	for _, t := range found {
+		if name != "" && t.Name != name {
+			continue
+		}
+		dir := config.TemplatesDir
+		if t.Archived {
+			dir = filepath.Join(dir, archiveDir)
+		}
+		meta, err := readTemplateMeta(dir, t.Name, t.Version)
+		if err == nil {
+			err = reconcileStatus(meta, t.Name, t.Version, t.Archived)
 		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "failed to read template metadata", "file", t.Filename, "error", err)
+		}
+		if (status != "" || len(tags) > 0) && meta == nil {
+			continue
+		}
+		if status != "" && meta.Status != status {
+			continue
+		}
+		if len(tags) > 0 && !meta.hasTags(tags) {
+			continue
+		}
+		t.TemplateMeta = meta
+		templates = append(templates, t)
 	}
 
 	// Sort by name, then by version descending
@@ -182,6 +256,444 @@ func handleListTemplates(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, ListResponse{Templates: templates})
 }
 
+// templateInfos describes the template files among directory entries
+func templateInfos(entries []os.DirEntry, archived bool) []TemplateInfo {
+	var templates []TemplateInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".html") {
+			continue
+		}
+
+		info := TemplateInfo{
+			Name:     strings.TrimSuffix(entry.Name(), ".html"),
+			Filename: entry.Name(),
+			Archived: archived,
+		}
+		if matches := versionPattern.FindStringSubmatch(entry.Name()); matches != nil {
+			info.Name = matches[1]
+			info.Version, _ = strconv.Atoi(matches[2])
+		}
+		templates = append(templates, info)
+	}
+	return templates
+}
+
+// templateVersionParams reads the template name and version from the request
+// path, writing a 400 response when either is invalid
+func templateVersionParams(w http.ResponseWriter, r *http.Request) (string, TemplateVersion, bool) {
+	name := sanitizeName(r.PathValue("name"))
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: "invalid template name"})
+		return "", TemplateVersion{}, false
+	}
+	version, err := parseTemplateVersion(r.PathValue("v"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: err.Error()})
+		return "", TemplateVersion{}, false
+	}
+	return name, version, true
+}
+
+// lookupTemplateVersion finds a stored or archived template version, writing
+// a 404 or 500 response when it can't
+func lookupTemplateVersion(w http.ResponseWriter, name string, version TemplateVersion) (*storedTemplate, bool) {
+	st, err := findTemplateVersion(name, version)
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) {
+			writeJSON(w, http.StatusNotFound, TemplateVersionResponse{Error: fmt.Sprintf("template %s not found", describeTemplateVersion(name, &version))})
+			return nil, false
+		}
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return nil, false
+	}
+	return st, true
+}
+
+// handleGetTemplateVersion handles GET /templates/{name}/versions/{v} - returns
+// a stored version with its sample data and schema, so it can be edited again
+func handleGetTemplateVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, version, ok := templateVersionParams(w, r)
+	if !ok {
+		return
+	}
+	st, ok := lookupTemplateVersion(w, name, version)
+	if !ok {
+		return
+	}
+
+	files, err := st.readFiles()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+	meta, err := decodeTemplateMeta(files[3])
+	if err == nil {
+		err = reconcileStatus(meta, st.Name, st.Version, st.Archived)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TemplateVersionResponse{
+		Name:         st.Name,
+		Version:      st.Version,
+		Filename:     st.Filename,
+		Archived:     st.Archived,
+		Modified:     st.ModTime,
+		Template:     string(files[0]),
+		Data:         string(files[1]),
+		Schema:       string(files[2]),
+		TemplateMeta: meta,
+	})
+}
+
+// handleDiffTemplate handles GET /templates/{name}/diff?from=&to= - returns a
+// unified diff between two versions of a template and of their sample data.
+// to defaults to the latest version and from to the version before it.
+func handleDiffTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := sanitizeName(r.PathValue("name"))
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: "invalid template name"})
+		return
+	}
+	query := r.URL.Query()
+	toVersion, err := parseTemplateVersion(query.Get("to"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: "to: " + err.Error()})
+		return
+	}
+	to, ok := lookupTemplateVersion(w, name, toVersion)
+	if !ok {
+		return
+	}
+
+	var fromVersion TemplateVersion
+	if query.Get("from") != "" {
+		if fromVersion, err = parseTemplateVersion(query.Get("from")); err != nil {
+			writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: "from: " + err.Error()})
+			return
+		}
+	} else {
+		versions, _ := templateVersions(name)
+		previous := -1
+		for _, v := range versions {
+			if v < to.Version {
+				previous = v
+			}
+		}
+		if previous < 0 {
+			writeJSON(w, http.StatusBadRequest, TemplateVersionResponse{Error: fmt.Sprintf("no version of %s before %d; from is required", name, to.Version)})
+			return
+		}
+		fromVersion = TemplateVersion{Number: previous}
+	}
+	from, ok := lookupTemplateVersion(w, name, fromVersion)
+	if !ok {
+		return
+	}
+
+	var diff strings.Builder
+	fromFiles, toFiles := templateFiles(from.Name, from.Version), templateFiles(to.Name, to.Version)
+	fromContent, err := from.readFiles()
+	if err == nil {
+		var toContent [][]byte
+		if toContent, err = to.readFiles(); err == nil {
+			// The template, then its sample data; schemas aren't diffed
+			for i := range 2 {
+				diff.WriteString(unifiedDiff("a/"+fromFiles[i], "b/"+toFiles[i], string(fromContent[i]), string(toContent[i])))
+			}
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, diff.String())
+}
+
+// handleArchiveTemplate handles POST /templates/{name}/versions/{v}/archive -
+// moves a version and its sidecars to the archive. Archived versions no longer
+// render or count as latest, but can still be fetched, diffed and restored.
+func handleArchiveTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, version, ok := templateVersionParams(w, r)
+	if !ok {
+		return
+	}
+	st, ok := lookupTemplateVersion(w, name, version)
+	if !ok {
+		return
+	}
+	if st.Archived {
+		writeJSON(w, http.StatusConflict, TemplateVersionResponse{Error: errTemplateArchived.Error()})
+		return
+	}
+
+	if err := archiveTemplate(st); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTemplateArchived) {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "archived template", "file", st.Filename, "version", st.Version)
+	writeJSON(w, http.StatusOK, TemplateVersionResponse{
+		Name:     st.Name,
+		Version:  st.Version,
+		Filename: st.Filename,
+		Archived: true,
+	})
+}
+
+// handleRestoreTemplate handles POST /templates/{name}/versions/{v}/restore -
+// copies a stored or archived version, with its sidecars, forward as the new
+// latest version
+func handleRestoreTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, version, ok := templateVersionParams(w, r)
+	if !ok {
+		return
+	}
+	st, ok := lookupTemplateVersion(w, name, version)
+	if !ok {
+		return
+	}
+
+	files, err := st.readFiles()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	if files[0] == nil {
+		// Archived since it was resolved
+		writeJSON(w, http.StatusNotFound, TemplateVersionResponse{Error: fmt.Sprintf("template %s not found", describeTemplateVersion(name, &version))})
+		return
+	}
+
+	// The copy is a new draft that keeps the original's tags
+	var tags []string
+	if old, err := decodeTemplateMeta(files[3]); err == nil && old != nil {
+		tags = old.Tags
+	}
+	var author string
+	if client := clientFromContext(r.Context()); client != nil {
+		author = client.ID
+	}
+	meta := newTemplateMeta(files[0], author, fmt.Sprintf("Restored from version %d", st.Version), tags, StatusDraft)
+	if files[3], err = meta.encode(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	next, err := saveTemplateVersion(name, files)
+	if err != nil {
+		writeJSON(w, saveErrorStatus(err), TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	filename := templateFilename(name, next)
+	slog.InfoContext(r.Context(), "restored template", "file", filename, "version", next, "restored_from", st.Version)
+	writeJSON(w, http.StatusOK, TemplateVersionResponse{
+		Name:         name,
+		Version:      next,
+		Filename:     filename,
+		RestoredFrom: &st.Version,
+		TemplateMeta: meta,
+	})
+}
+
+// handlePublishTemplate handles POST /templates/{name}/versions/{v}/publish -
+// marks a version published, so renders of "latest" use it, and deprecates
+// the version published before it
+func handlePublishTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, version, ok := templateVersionParams(w, r)
+	if !ok {
+		return
+	}
+	st, ok := lookupTemplateVersion(w, name, version)
+	if !ok {
+		return
+	}
+	if st.Archived {
+		writeJSON(w, http.StatusConflict, TemplateVersionResponse{Error: "archived versions can't be published; restore it first"})
+		return
+	}
+
+	meta, err := publishTemplate(st)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, TemplateVersionResponse{Error: err.Error()})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "published template", "file", st.Filename, "version", st.Version)
+	writeJSON(w, http.StatusOK, TemplateVersionResponse{
+		Name:         st.Name,
+		Version:      st.Version,
+		Filename:     st.Filename,
+		TemplateMeta: meta,
+	})
+}
+
+// handleCacheStats handles GET /templates/cache - reports parsed-template cache usage
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, tmplCache.stats())
+}
+
+// handleLimitStats handles GET /limits - reports rate limiter and render gate usage
+func handleLimitStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, limits.stats())
+}
+
+// handleSubmitJob handles POST /jobs/pdf - queues a PDF render and returns its job ID
+func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PDFRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, decodeStatus(err), JobResponse{Error: "invalid json: " + err.Error()})
+		return
+	}
+
+	queueJob(w, r, &req)
+}
+
+// queueJob validates a PDF request and queues it as an asynchronous job
+func queueJob(w http.ResponseWriter, r *http.Request, req *PDFRequest) {
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			writeJSON(w, http.StatusBadRequest, JobResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	// Reject bad options, templates and payloads now rather than in the worker
+	if _, err := req.PDFOptions.printParams(); err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	// Images are fetched by the worker, not at submission
+	in := req.renderInput()
+	in.InlineImages = false
+	prepared, err := prepareRender(r.Context(), in)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	if _, _, err := headerFooterTemplates(req, prepared.tmpl); err != nil {
+		writeRenderError(w, err)
+		return
+	}
+
+	job, err := jobs.submit(r.Context(), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errQueueFull) || errors.Is(err, errQueueClosed) {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, JobResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job.response())
+}
+
+// handleJobStatus handles GET /jobs/{id} - reports the status of a PDF job
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := jobs.get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.response())
+}
+
+// handleJobResult handles GET /jobs/{id}/result - downloads the PDF of a finished job
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := jobs.get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	if job.Status != JobDone {
+		writeJSON(w, http.StatusConflict, job.response())
+		return
+	}
+
+	pdfBytes, err := jobs.result(job.ID)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", job.Filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdfBytes)))
+	w.Write(pdfBytes)
+}
+
+// writeJobError writes a job lookup failure as a JSON error response
+func writeJobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errJobNotFound) {
+		writeJSON(w, http.StatusNotFound, JobResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, JobResponse{Error: err.Error()})
+}
+
 // handleUploadDMS handles POST /templates/upload-dms - uploads a template to DMS
 func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -199,7 +711,7 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 
 	var req UploadDMSRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, UploadDMSResponse{Error: "invalid json: " + err.Error()})
+		writeJSON(w, decodeStatus(err), UploadDMSResponse{Error: "invalid json: " + err.Error()})
 		return
 	}
 
@@ -227,10 +739,28 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 		req.DocumentSequence = "1"
 	}
 
+	// Only stored template versions can be uploaded, so the file name is
+	// resolved to one rather than read as a path
+	name, version, ok := parseTemplateFilename(req.Filename)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, UploadDMSResponse{Error: "filename must be a stored template file, such as data-application-v1.html"})
+		return
+	}
+	st, err := resolveStoredTemplate(name, &TemplateVersion{Number: version})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTemplateNotFound) {
+			status = http.StatusNotFound
+			err = fmt.Errorf("template %s not found", req.Filename)
+		}
+		writeJSON(w, status, UploadDMSResponse{Error: err.Error()})
+		return
+	}
+
 	// Read the template file
-	fileContent, err := readTemplateFile(req.Filename)
+	fileContent, err := readTemplateFile(st.Filename)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, UploadDMSResponse{
+		writeJSON(w, http.StatusInternalServerError, UploadDMSResponse{
 			Error: fmt.Sprintf("failed to read template file: %v", err),
 		})
 		return
@@ -241,7 +771,7 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 	writer := multipart.NewWriter(&body)
 
 	// Add the file
-	part, err := writer.CreateFormFile("file", req.Filename)
+	part, err := writer.CreateFormFile("file", st.Filename)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, UploadDMSResponse{Error: "failed to create form file"})
 		return
@@ -264,7 +794,7 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create the request to DMS
-	dmsReq, err := http.NewRequest(http.MethodPost, config.DMS.APIURL, &body)
+	dmsReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, config.DMS.APIURL, &body)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, UploadDMSResponse{Error: "failed to create DMS request"})
 		return
@@ -272,11 +802,14 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 
 	dmsReq.Header.Set("Content-Type", writer.FormDataContentType())
 	dmsReq.Header.Set("api-secret", config.DMS.APISecret)
+	dmsReq.Header.Set(requestIDHeader, requestIDFromContext(r.Context()))
 
 	// Send the request
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := &http.Client{Timeout: config.DMS.Timeout, Transport: tracedTransport(nil)}
 	resp, err := client.Do(dmsReq)
 	if err != nil {
+		dmsUploads.WithLabelValues("error", "none").Inc()
+		slog.ErrorContext(r.Context(), "DMS request failed", "file", req.Filename, "error", err)
 		writeJSON(w, http.StatusBadGateway, UploadDMSResponse{
 			Error: fmt.Sprintf("DMS request failed: %v", err),
 		})
@@ -289,13 +822,16 @@ func handleUploadDMS(w http.ResponseWriter, r *http.Request) {
 	respString := string(respBody)
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("uploaded template to DMS: %s (ref_id: %s)", req.Filename, req.RefID)
+		dmsUploads.WithLabelValues("success", strconv.Itoa(resp.StatusCode)).Inc()
+		slog.InfoContext(r.Context(), "uploaded template to DMS", "file", req.Filename, "ref_id", req.RefID)
 		writeJSON(w, http.StatusOK, UploadDMSResponse{
 			Success:  true,
 			Message:  fmt.Sprintf("Template %s uploaded successfully", req.Filename),
 			Response: respString,
 		})
 	} else {
+		dmsUploads.WithLabelValues("rejected", strconv.Itoa(resp.StatusCode)).Inc()
+		slog.WarnContext(r.Context(), "DMS rejected upload", "file", req.Filename, "status", resp.StatusCode)
 		writeJSON(w, http.StatusBadGateway, UploadDMSResponse{
 			Error:    fmt.Sprintf("DMS returned status %d", resp.StatusCode),
 			Response: respString,
@@ -318,51 +854,146 @@ func handleRenderPDF(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "invalid json: " + err.Error()})
+		writeJSON(w, decodeStatus(err), RenderResponse{Error: "invalid json: " + err.Error()})
 		return
 	}
 
-	if req.Template == "" {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template is required"})
+	// With a callback the render runs as a job and the caller is notified
+	if req.CallbackURL != "" {
+		queueJob(w, r, &req)
 		return
 	}
-	if req.Data == nil {
-		req.Data = map[string]interface{}{}
+
+	out, err := renderPDF(r.Context(), &req)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+
+	if out.stored != nil {
+		w.Header().Set("X-Template-File", out.stored.Filename)
+		w.Header().Set("X-Template-Version", strconv.Itoa(out.stored.Version))
+	}
+	if len(out.violations) > 0 {
+		w.Header().Set("X-Schema-Violations", strconv.Itoa(len(out.violations)))
+	}
+	if out.redaction != "" {
+		w.Header().Set("X-Redaction-Profile", out.redaction)
+	}
+	if len(out.ResourceErrors) > 0 {
+		w.Header().Set("X-Resource-Error-Count", strconv.Itoa(len(out.ResourceErrors)))
+		w.Header().Set("X-Resource-Errors", headerList(out.ResourceErrors))
 	}
 
-	// Auto-convert URL-like strings to safe URLs (for base64 images, etc.)
-	safeData := sanitizeDataForTemplate(req.Data)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", out.Filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out.PDF)))
+	w.Write(out.PDF)
+}
 
-	// Parse and execute Go template
-	tmpl, err := template.New("pdf").Funcs(templateFuncMap).Option("missingkey=default").Parse(req.Template)
-	if err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template parse error: " + err.Error()})
+// handleRenderBatch renders several PDFs in one request and returns them as a
+// ZIP (with a manifest.json) or as a single merged PDF with a bookmark per item.
+// Items fail independently; failures are listed in the manifest and, up to the
+// header size limit, in the X-Batch-Errors header.
+func handleRenderBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BatchRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, decodeStatus(err), BatchResponse{Error: "invalid json: " + err.Error()})
 		return
 	}
 
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, safeData); err != nil {
-		writeJSON(w, http.StatusBadRequest, RenderResponse{Error: "template execute error: " + err.Error()})
+	if len(req.Items) == 0 {
+		writeJSON(w, http.StatusBadRequest, BatchResponse{Error: "items is required"})
+		return
+	}
+	if len(req.Items) > config.Batch.MaxItems {
+		writeJSON(w, http.StatusBadRequest, BatchResponse{
+			Error: fmt.Sprintf("too many items: %d (max %d)", len(req.Items), config.Batch.MaxItems),
+		})
 		return
 	}
+	if req.Output == "" {
+		req.Output = "zip"
+	}
+	if req.Output != "zip" && req.Output != "merged" {
+		writeJSON(w, http.StatusBadRequest, BatchResponse{Error: "output must be zip or merged"})
+		return
+	}
+	concurrency := config.Batch.Concurrency
+	if req.Concurrency > 0 && req.Concurrency < concurrency {
+		concurrency = req.Concurrency
+	}
 
-	htmlContent := buf.String()
+	// A batch can outlast the server's write timeout, which would cut its
+	// response off, so its write deadline is pushed back by the time its
+	// renders may take. Renders still waiting for a slot by then fail instead.
+	renderTime := time.Duration((len(req.Items)+concurrency-1)/concurrency) * renderTimeout
+	if config.Server.WriteTimeout > 0 {
+		deadline := time.Now().Add(renderTime + config.Server.WriteTimeout)
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			slog.WarnContext(r.Context(), "failed to extend batch write deadline", "error", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), renderTime)
+	defer cancel()
 
-	// Generate PDF using chromedp
-	pdfBytes, err := generatePDF(htmlContent, req.WaitAfterLoad)
-	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, RenderResponse{Error: "pdf generation error: " + err.Error()})
+	items := renderBatch(ctx, req.Items, concurrency)
+
+	var failed []BatchItemResult
+	results := make([]BatchItemResult, len(items))
+	for i, item := range items {
+		results[i] = item.result
+		if item.pdf == nil {
+			failed = append(failed, item.result)
+		}
+	}
+	slog.InfoContext(r.Context(), "rendered batch", "items", len(items), "failed", len(failed))
+	if len(failed) == len(items) {
+		writeJSON(w, http.StatusUnprocessableEntity, BatchResponse{Items: results, Error: "all batch items failed"})
 		return
 	}
 
-	// Set filename for download
-	filename := "document.pdf"
+	var (
+		body        []byte
+		err         error
+		contentType string
+	)
+	filename := "batch"
 	if req.Filename != "" {
-		filename = sanitizeName(req.Filename) + ".pdf"
+		filename = sanitizeName(req.Filename)
+	}
+	if req.Output == "merged" {
+		body, err = batchMerged(items)
+		contentType = "application/pdf"
+		filename += ".pdf"
+	} else {
+		body, err = batchZip(items)
+		contentType = "application/zip"
+		filename += ".zip"
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, BatchResponse{Items: results, Error: err.Error()})
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("X-Batch-Items", strconv.Itoa(len(items)))
+	w.Header().Set("X-Batch-Failed", strconv.Itoa(len(failed)))
+	if len(failed) > 0 {
+		w.Header().Set("X-Batch-Errors", headerList(failed))
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Length", strconv.Itoa(len(pdfBytes)))
-	w.Write(pdfBytes)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
 }
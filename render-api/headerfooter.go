@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	"github.com/chromedp/cdproto/page"
+)
+
+// Names of the partials a template defines for running page headers and footers,
+// e.g. {{define "pdf-footer"}}Halaman {{pageNumber}} dari {{totalPages}}{{end}}
+const (
+	headerPartial = "pdf-header"
+	footerPartial = "pdf-footer"
+)
+
+// headerFooterWrapper styles a rendered header or footer. Chrome prints them
+// outside the page's CSS with a tiny default font and no padding.
+const headerFooterWrapper = `<div style="width:100%;box-sizing:border-box;padding:0 10mm;font-size:9px;font-family:sans-serif;-webkit-print-color-adjust:exact;">`
+
+// emptyHeaderFooter replaces Chrome's default date and title header when only
+// one of the header or footer is given
+const emptyHeaderFooter = `<span></span>`
+
+// Placeholders Chrome fills in when printing headers and footers
+var (
+	pageNumberSpan    = template.HTML(`<span class="pageNumber"></span>`)
+	totalPagesSpan    = template.HTML(`<span class="totalPages"></span>`)
+	documentTitleSpan = template.HTML(`<span class="title"></span>`)
+)
+
+// headerFooterTemplates returns the header and footer partials of a PDF render:
+// those sent in the request, or else those defined by the template. Either may be nil.
+func headerFooterTemplates(req *PDFRequest, tmpl *template.Template) (header, footer *template.Template, err error) {
+	pick := func(source, partial string) (*template.Template, error) {
+		if source != "" {
+			t, err := tmplCache.inline(partial, source)
+			if err != nil {
+				return nil, newRenderError(http.StatusBadRequest, partial+" parse error: "+err.Error())
+			}
+			return t, nil
+		}
+		return tmpl.Lookup(partial), nil
+	}
+
+	if header, err = pick(req.Header, headerPartial); err != nil {
+		return nil, nil, err
+	}
+	if footer, err = pick(req.Footer, footerPartial); err != nil {
+		return nil, nil, err
+	}
+	return header, footer, nil
+}
+
+// applyHeaderFooter renders the header and footer partials of a PDF request with
+// the render's data and sets them as Chrome's header and footer templates
+func applyHeaderFooter(req *PDFRequest, out *renderedHTML, params *page.PrintToPDFParams) error {
+	header, footer, err := headerFooterTemplates(req, out.tmpl)
+	if err != nil || (header == nil && footer == nil) {
+		return err
+	}
+
+	render := func(t *template.Template) (string, error) {
+		var buf bytes.Buffer
+		buf.WriteString(headerFooterWrapper)
+		if err := t.Execute(&buf, out.data); err != nil {
+			return "", newRenderError(http.StatusBadRequest, t.Name()+" execute error: "+err.Error())
+		}
+		buf.WriteString(`</div>`)
+		return buf.String(), nil
+	}
+
+	if header != nil {
+		if params.HeaderTemplate, err = render(header); err != nil {
+			return err
+		}
+	}
+	if footer != nil {
+		if params.FooterTemplate, err = render(footer); err != nil {
+			return err
+		}
+	}
+
+	params.DisplayHeaderFooter = true
+	if params.HeaderTemplate == "" {
+		params.HeaderTemplate = emptyHeaderFooter
+	}
+	if params.FooterTemplate == "" {
+		params.FooterTemplate = emptyHeaderFooter
+	}
+	return nil
+}
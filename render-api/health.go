@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+// ready runs the readiness checks behind /readyz and /version
+var ready *readiness
+
+// Component check states reported by /readyz
+const (
+	checkOK       = "ok"
+	checkFailed   = "failed"
+	checkDisabled = "disabled"
+)
+
+// ComponentStatus is the outcome of one readiness check
+type ComponentStatus struct {
+	Status     string    `json:"status"`
+	Required   bool      `json:"required"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at,omitzero"`
+	DurationMs int64     `json:"duration_ms,omitzero"`
+}
+
+// ReadyResponse is returned by GET /readyz
+type ReadyResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// ChromeVersion is the browser version reported over CDP
+type ChromeVersion struct {
+	Product         string `json:"product"`
+	ProtocolVersion string `json:"protocol_version"`
+	Revision        string `json:"revision"`
+	UserAgent       string `json:"user_agent"`
+	JSVersion       string `json:"js_version"`
+}
+
+// VersionResponse is returned by GET /version
+type VersionResponse struct {
+	Version   string         `json:"version"`
+	Revision  string         `json:"revision,omitempty"`
+	BuildTime string         `json:"build_time,omitempty"`
+	Modified  bool           `json:"modified,omitempty"`
+	GoVersion string         `json:"go_version"`
+	Chrome    *ChromeVersion `json:"chrome,omitempty"`
+	ChromeErr string         `json:"chrome_error,omitempty"`
+}
+
+// cachedCheck runs a check at most once per TTL. Concurrent callers share the
+// run in progress instead of starting their own.
+type cachedCheck struct {
+	name     string
+	required bool
+	ttl      time.Duration
+	run      func(ctx context.Context) error
+
+	mu     sync.Mutex
+	status ComponentStatus
+}
+
+// get returns the cached status, running the check first when it is stale
+func (c *cachedCheck) get(ctx context.Context) ComponentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.status.CheckedAt.IsZero() && time.Since(c.status.CheckedAt) < c.ttl {
+		return c.status
+	}
+
+	start := time.Now()
+	err := c.run(ctx)
+	c.status = ComponentStatus{
+		Status:     checkOK,
+		Required:   c.required,
+		CheckedAt:  start,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		c.status.Status = checkFailed
+		c.status.Error = err.Error()
+		slog.WarnContext(ctx, "readiness check failed", "component", c.name, "error", err)
+	}
+	return c.status
+}
+
+// readiness checks the templates directory, Chrome and, when configured, DMS
+type readiness struct {
+	cfg         HealthConfig
+	checks      []*cachedCheck
+	chromeCheck *cachedCheck
+
+	mu     sync.Mutex
+	chrome *ChromeVersion // reported by the last successful Chrome launch
+}
+
+// newReadiness sets up the readiness checks. Only the templates check runs on
+// every request; launching Chrome and calling DMS are cached for cfg.CacheTTL.
+func newReadiness(cfg HealthConfig) *readiness {
+	rd := &readiness{cfg: cfg}
+	rd.chromeCheck = &cachedCheck{name: "chrome", required: true, ttl: cfg.CacheTTL, run: rd.checkChrome}
+	rd.checks = []*cachedCheck{
+		{name: "templates", required: true, run: checkTemplatesDir},
+		rd.chromeCheck,
+	}
+	if config.DMS.APIURL != "" {
+		rd.checks = append(rd.checks, &cachedCheck{name: "dms", required: cfg.RequireDMS, ttl: cfg.CacheTTL, run: rd.checkDMS})
+	}
+	return rd
+}
+
+// check runs every readiness check. The service is ready when all required
+// components are.
+func (rd *readiness) check(ctx context.Context) ReadyResponse {
+	res := ReadyResponse{Status: checkOK, Components: make(map[string]ComponentStatus, len(rd.checks)+1)}
+	for _, c := range rd.checks {
+		s := c.get(ctx)
+		if s.Status != checkOK && c.required {
+			res.Status = checkFailed
+		}
+		res.Components[c.name] = s
+	}
+	if config.DMS.APIURL == "" {
+		res.Components["dms"] = ComponentStatus{Status: checkDisabled}
+	}
+	return res
+}
+
+// chromeVersion returns the Chrome version, launching Chrome if it hasn't been
+// checked yet
+func (rd *readiness) chromeVersion(ctx context.Context) (*ChromeVersion, error) {
+	s := rd.chromeCheck.get(ctx)
+	if s.Status != checkOK {
+		return nil, errors.New(s.Error)
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	return rd.chrome, nil
+}
+
+// checkTemplatesDir verifies the templates directory can be listed
+func checkTemplatesDir(context.Context) error {
+	if _, err := os.ReadDir(config.TemplatesDir); err != nil {
+		return fmt.Errorf("templates directory not readable: %w", err)
+	}
+	return nil
+}
+
+// checkChrome launches a throwaway Chrome with the pool's options and asks it
+// for its version, so a broken binary is caught even while pooled browsers
+// are still running
+func (rd *readiness) checkChrome(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rd.cfg.CheckTimeout)
+	defer cancel()
+
+	allocCtx, allocCancel := chromedp.NewExecAllocator(ctx, pdfPool.opts...)
+	defer allocCancel()
+	browserCtx, browserCancel := chromedp.NewContext(allocCtx)
+	defer browserCancel()
+
+	var v ChromeVersion
+	err := chromedp.Run(browserCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		v.ProtocolVersion, v.Product, v.Revision, v.UserAgent, v.JSVersion, err = browser.GetVersion().Do(ctx)
+		return err
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to start chrome: %w", err)
+	}
+
+	rd.mu.Lock()
+	rd.chrome = &v
+	rd.mu.Unlock()
+	return nil
+}
+
+// checkDMS verifies the DMS host answers HTTP. Any response counts, since the
+// upload URL doesn't accept a bare request.
+func (rd *readiness) checkDMS(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rd.cfg.CheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, config.DMS.APIURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid DMS_API_URL: %w", err)
+	}
+	client := &http.Client{Transport: tracedTransport(nil)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("DMS unreachable: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// handleHealthz handles GET /healthz - reports that the process is serving requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": checkOK})
+}
+
+// handleReadyz handles GET /readyz - reports whether the API can render, with
+// the status of each component
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "shutting_down"})
+		return
+	}
+	res := ready.check(r.Context())
+	status := http.StatusOK
+	if res.Status != checkOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
+
+// handleVersion handles GET /version - reports build information and the Chrome version
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := VersionResponse{Version: "(devel)", GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		res.Version = info.Main.Version
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				res.Revision = s.Value
+			case "vcs.time":
+				res.BuildTime = s.Value
+			case "vcs.modified":
+				res.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	chrome, err := ready.chromeVersion(r.Context())
+	if err != nil {
+		res.ChromeErr = err.Error()
+	}
+	res.Chrome = chrome
+	writeJSON(w, http.StatusOK, res)
+}
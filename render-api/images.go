@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	_ "image/gif"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageFetcher downloads remote images from request payloads so they can be
+// embedded as data: URIs instead of being fetched by Chrome while printing
+type imageFetcher struct {
+	cfg         ImageConfig
+	client      *http.Client
+	placeholder string // data: URI substituted for images that fail to download
+}
+
+// images is the shared image pre-fetcher
+var images *imageFetcher
+
+// newImageFetcher creates a fetcher using the configured limits and placeholder.
+// Downloads obey the outbound resource policy.
+func newImageFetcher(cfg ImageConfig, policy *resourcePolicy) (*imageFetcher, error) {
+	f := &imageFetcher{
+		cfg:    cfg,
+		client: policy.httpClient(cfg.FetchTimeout),
+	}
+
+	if cfg.Placeholder != "" {
+		content, err := os.ReadFile(cfg.Placeholder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read placeholder image: %w", err)
+		}
+		f.placeholder = dataURI(http.DetectContentType(content), content)
+	} else {
+		// A 1x1 light gray pixel, stretched by the template's image size
+		img := image.NewGray(image.Rect(0, 0, 1, 1))
+		img.SetGray(0, 0, color.Gray{Y: 0xe0})
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		f.placeholder = dataURI("image/png", buf.Bytes())
+	}
+	return f, nil
+}
+
+// inline returns a copy of data with every http(s) image URL on an allowed
+// host replaced by a data: URI. Images that fail to download are replaced by
+// the placeholder and reported; URLs that aren't images are left unchanged.
+// At most images.max_count URLs are downloaded; the rest are reported
+// and left for Chrome.
+func (f *imageFetcher) inline(ctx context.Context, data map[string]interface{}) (map[string]interface{}, []ResourceError) {
+	var urls []string
+	var failed []ResourceError
+	seen := make(map[string]bool)
+	walkStrings(data, func(s string) {
+		if seen[s] || !(strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")) {
+			return
+		}
+		seen[s] = true
+		if u, err := url.Parse(s); err != nil || (len(f.cfg.AllowedHosts) > 0 && !hostMatches(u.Hostname(), f.cfg.AllowedHosts)) {
+			return
+		}
+		if len(urls) >= f.cfg.MaxCount {
+			failed = append(failed, ResourceError{URL: displayURL(s), Error: fmt.Sprintf("prefetch: more than %d URLs in the request", f.cfg.MaxCount)})
+			return
+		}
+		urls = append(urls, s)
+	})
+	if len(urls) == 0 {
+		return data, failed
+	}
+
+	ctx, span := tracer.Start(ctx, "images.inline", trace.WithAttributes(attribute.Int("images.count", len(urls))))
+	defer span.End()
+
+	type fetched struct {
+		uri string
+		err error
+	}
+	results := make(map[string]fetched, len(urls))
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, f.cfg.Concurrency)
+	)
+	for _, u := range urls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			uri, err := f.fetch(ctx, u)
+			mu.Lock()
+			results[u] = fetched{uri, err}
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	for _, u := range urls {
+		if r := results[u]; r.err != nil && r.err != errNotImage {
+			slog.WarnContext(ctx, "image prefetch failed", "url", displayURL(u), "error", r.err)
+			failed = append(failed, ResourceError{URL: displayURL(u), Error: "prefetch: " + r.err.Error()})
+		}
+	}
+	span.SetAttributes(attribute.Int("images.failed", len(failed)))
+
+	out := mapStrings(data, func(s string) string {
+		r, ok := results[s]
+		switch {
+		case !ok || r.err == errNotImage:
+			return s
+		case r.err != nil:
+			return f.placeholder
+		default:
+			return r.uri
+		}
+	})
+	return out, failed
+}
+
+// errNotImage marks URLs that don't point at an image; they are left as they are
+var errNotImage = errors.New("not an image")
+
+// fetch downloads one image and returns it as a data: URI, downscaled if it is
+// larger than the configured maximum dimension
+func (f *imageFetcher) fetch(ctx context.Context, rawURL string) (uri string, err error) {
+	ctx, span := tracer.Start(ctx, "image.fetch", trace.WithAttributes(attribute.String("url.full", displayURL(rawURL))))
+	defer func() {
+		if err == errNotImage {
+			span.SetAttributes(attribute.Bool("image.skipped", true))
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > f.cfg.MaxBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", f.cfg.MaxBytes)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(content)) > f.cfg.MaxBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", f.cfg.MaxBytes)
+	}
+
+	contentType := http.DetectContentType(content)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", errNotImage
+	}
+	if contentType, content, err = f.downscale(contentType, content); err != nil {
+		return "", err
+	}
+	return dataURI(contentType, content), nil
+}
+
+// downscale re-encodes an image whose width or height exceeds the configured
+// maximum, keeping its aspect ratio. Images with more than the configured
+// number of pixels are rejected from their header, before anything is
+// decoded. Smaller images and formats that can't be decoded are returned
+// unchanged.
+func (f *imageFetcher) downscale(contentType string, content []byte) (string, []byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return contentType, content, nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(f.cfg.MaxPixels) {
+		return "", nil, fmt.Errorf("image is %dx%d, more than %d pixels", cfg.Width, cfg.Height, f.cfg.MaxPixels)
+	}
+	if f.cfg.MaxDimension <= 0 || (cfg.Width <= f.cfg.MaxDimension && cfg.Height <= f.cfg.MaxDimension) {
+		return contentType, content, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	w, h := cfg.Width, cfg.Height
+	if w >= h {
+		w, h = f.cfg.MaxDimension, h*f.cfg.MaxDimension/w
+	} else {
+		w, h = w*f.cfg.MaxDimension/h, f.cfg.MaxDimension
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: f.cfg.JPEGQuality})
+	} else {
+		// Keep transparency for everything else
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return contentType, buf.Bytes(), nil
+}
+
+// dataURI encodes content as a base64 data: URI
+func dataURI(contentType string, content []byte) string {
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(content)
+}
+
+// walkStrings calls fn with every string in a JSON value
+func walkStrings(v interface{}, fn func(string)) {
+	switch val := v.(type) {
+	case string:
+		fn(val)
+	case map[string]interface{}:
+		for _, item := range val {
+			walkStrings(item, fn)
+		}
+	case []interface{}:
+		for _, item := range val {
+			walkStrings(item, fn)
+		}
+	}
+}
+
+// mapStrings returns a copy of a JSON map with every string replaced by fn(string)
+func mapStrings(data map[string]interface{}, fn func(string) string) map[string]interface{} {
+	result := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		result[k] = mapStringValue(v, fn)
+	}
+	return result
+}
+
+func mapStringValue(v interface{}, fn func(string) string) interface{} {
+	switch val := v.(type) {
+	case string:
+		return fn(val)
+	case map[string]interface{}:
+		return mapStrings(val, fn)
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, item := range val {
+			result[i] = mapStringValue(item, fn)
+		}
+		return result
+	default:
+		return val
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pngOf encodes a blank w×h PNG
+func pngOf(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownscale(t *testing.T) {
+	f := &imageFetcher{cfg: ImageConfig{MaxDimension: 100, MaxPixels: 250_000}}
+
+	contentType, content, err := f.downscale("image/png", pngOf(t, 400, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || contentType != "image/png" || cfg.Width != 100 || cfg.Height != 50 {
+		t.Errorf("downscaled to %s %dx%d (%v), want image/png 100x50", contentType, cfg.Width, cfg.Height, err)
+	}
+
+	small := pngOf(t, 80, 60)
+	if _, content, err := f.downscale("image/png", small); err != nil || !bytes.Equal(content, small) {
+		t.Errorf("small image changed: %v", err)
+	}
+
+	// Rejected from the header, whether or not it would be downscaled
+	if _, _, err := f.downscale("image/png", pngOf(t, 600, 500)); err == nil || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("600x500 image with a 250000 pixel limit: got %v", err)
+	}
+	f.cfg.MaxDimension = 0
+	if _, _, err := f.downscale("image/png", pngOf(t, 600, 500)); err == nil {
+		t.Error("pixel limit not applied without a maximum dimension")
+	}
+
+	if _, content, err := f.downscale("image/svg+xml", []byte("<svg/>")); err != nil || string(content) != "<svg/>" {
+		t.Errorf("undecodable image changed: %q, %v", content, err)
+	}
+}
+
+func TestInlineMaxCount(t *testing.T) {
+	logo := pngOf(t, 4, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(logo)
+	}))
+	defer srv.Close()
+
+	f, err := newImageFetcher(ImageConfig{MaxBytes: 1 << 20, FetchTimeout: 5 * time.Second, Concurrency: 2, MaxPixels: 1 << 20, MaxCount: 2}, loopbackPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{
+		"photos": []interface{}{srv.URL + "/1.png", srv.URL + "/2.png", srv.URL + "/3.png", srv.URL + "/1.png"},
+		"note":   "plain text",
+	}
+	out, failed := f.inline(context.Background(), data)
+
+	if len(failed) != 1 || !strings.Contains(failed[0].Error, "more than 2 URLs") {
+		t.Fatalf("resource errors = %+v, want one over the limit", failed)
+	}
+	inlined := 0
+	for _, v := range out["photos"].([]interface{}) {
+		if strings.HasPrefix(v.(string), "data:image/png;base64,") {
+			inlined++
+		} else if v != failed[0].URL {
+			t.Errorf("photo %q is neither inlined nor the reported URL", v)
+		}
+	}
+	if inlined != 3 {
+		t.Errorf("%d photos inlined, want 3 (two URLs, one repeated)", inlined)
+	}
+	if out["note"] != "plain text" {
+		t.Errorf("note = %v", out["note"])
+	}
+}
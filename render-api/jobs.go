@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// errQueueFull is returned when no more jobs can be queued
+	errQueueFull = errors.New("job queue is full")
+	// errQueueClosed is returned when jobs are submitted during shutdown
+	errQueueClosed = errors.New("job queue is shutting down")
+)
+
+// jobIDPattern matches the IDs generated by newJobID
+var jobIDPattern = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// jobs is the shared asynchronous PDF job queue
+var jobs *jobQueue
+
+// JobStatus is the lifecycle state of an asynchronous job
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is an asynchronous PDF render and its outcome
+type Job struct {
+	ID              string          `json:"id"`
+	Status          JobStatus       `json:"status"`
+	Error           string          `json:"error,omitempty"`
+	Filename        string          `json:"filename,omitempty"`
+	Size            int             `json:"size,omitempty"`
+	SHA256          string          `json:"sha256,omitempty"`
+	TemplateFile    string          `json:"template_file,omitempty"`
+	TemplateVersion int             `json:"template_version,omitempty"`
+	ResourceErrors  []ResourceError `json:"resource_errors,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+	Callback        *CallbackState  `json:"callback,omitempty"`
+	Request         *PDFRequest     `json:"request,omitempty"`    // dropped once the job finishes
+	RequestID       string          `json:"request_id,omitempty"` // X-Request-ID of the submitting request
+	ClientID        string          `json:"client_id,omitempty"`  // authenticated client that submitted the job
+}
+
+// response returns the job status as reported by the API
+func (j *Job) response() JobResponse {
+	resp := JobResponse{
+		ID:              j.ID,
+		Status:          j.Status,
+		Filename:        j.Filename,
+		Size:            j.Size,
+		SHA256:          j.SHA256,
+		TemplateFile:    j.TemplateFile,
+		TemplateVersion: j.TemplateVersion,
+		ResourceErrors:  j.ResourceErrors,
+		CreatedAt:       j.CreatedAt,
+		StartedAt:       j.StartedAt,
+		FinishedAt:      j.FinishedAt,
+		Callback:        j.Callback,
+		Error:           j.Error,
+	}
+	if j.Status == JobDone {
+		resp.ResultURL = "/jobs/" + j.ID + "/result"
+	}
+	return resp
+}
+
+// context returns a background context carrying the job's request ID, so the
+// worker's logs and webhook calls can be traced to the submitting request
+func (j *Job) context() context.Context {
+	return withRequestIDContext(context.Background(), j.RequestID)
+}
+
+// clone returns a copy of the job that shares no mutable state with it
+func (j *Job) clone() *Job {
+	c := *j
+	if j.Callback != nil {
+		cb := *j.Callback
+		cb.Attempts = append([]CallbackAttempt(nil), j.Callback.Attempts...)
+		c.Callback = &cb
+	}
+	return &c
+}
+
+// newJobID returns a random 128-bit hex job ID
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jobQueue runs PDF jobs on a fixed number of workers
+type jobQueue struct {
+	cfg        JobsConfig
+	store      JobStore
+	webhooks   *webhookSender
+	pending    chan string
+	done       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup // running workers
+	deliveries sync.WaitGroup // in-flight webhook deliveries
+}
+
+// newJobQueue creates a job queue backed by the configured store
+func newJobQueue(cfg JobsConfig, webhooks *webhookSender) (*jobQueue, error) {
+	store, err := newJobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &jobQueue{
+		cfg:      cfg,
+		store:    store,
+		webhooks: webhooks,
+		pending:  make(chan string, cfg.QueueSize),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// start launches the workers, re-queues jobs left over from a previous run
+// and starts expiring old results
+func (q *jobQueue) start() {
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	go q.recoverJobs()
+	go q.janitor()
+}
+
+// submit stores a new job and queues it for rendering. The request ID and
+// authenticated client of ctx are recorded on the job.
+func (q *jobQueue) submit(ctx context.Context, req *PDFRequest) (*Job, error) {
+	select {
+	case <-q.done:
+		return nil, errQueueClosed
+	default:
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate job id: %w", err)
+	}
+	job := &Job{
+		ID:        id,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+		RequestID: requestIDFromContext(ctx),
+	}
+	if client := clientFromContext(ctx); client != nil {
+		job.ClientID = client.ID
+	}
+	if req.CallbackURL != "" {
+		job.Callback = &CallbackState{URL: req.CallbackURL, Inline: req.CallbackInline, secret: req.CallbackSecret}
+	}
+	// The secret lives on the callback, never in the stored request
+	stored := *req
+	stored.CallbackSecret = ""
+	job.Request = &stored
+
+	if err := q.store.Save(job); err != nil {
+		return nil, fmt.Errorf("failed to save job: %w", err)
+	}
+
+	select {
+	case q.pending <- id:
+		slog.InfoContext(ctx, "queued pdf job", "job_id", id)
+		return job, nil
+	default:
+		if err := q.store.Delete(id); err != nil {
+			slog.ErrorContext(ctx, "failed to delete rejected job", "job_id", id, "error", err)
+		}
+		return nil, errQueueFull
+	}
+}
+
+// get returns a job by ID. A job submitted by another client than the
+// authenticated client of ctx is reported as not found, so job IDs can't be
+// used to read other clients' documents.
+func (q *jobQueue) get(ctx context.Context, id string) (*Job, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, errJobNotFound
+	}
+	job, err := q.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if client := clientFromContext(ctx); client != nil && client.ID != job.ClientID {
+		return nil, errJobNotFound
+	}
+	return job, nil
+}
+
+// result returns the PDF of a finished job
+func (q *jobQueue) result(id string) ([]byte, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, errJobNotFound
+	}
+	return q.store.Result(id)
+}
+
+// worker renders queued jobs until the queue is closed
+func (q *jobQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case id := <-q.pending:
+			q.run(id)
+		}
+	}
+}
+
+// run renders one job and records its outcome
+func (q *jobQueue) run(id string) {
+	job, err := q.store.Get(id)
+	if err != nil {
+		slog.Error("failed to load pdf job", "job_id", id, "error", err)
+		return
+	}
+	// Jobs share the render gate with synchronous renders, waiting for a slot
+	ctx, span := tracer.Start(withRenderWait(job.context()), "job.render", trace.WithAttributes(attribute.String("job.id", id)))
+	defer span.End()
+
+	started := time.Now().UTC()
+	job.Status = JobRunning
+	job.StartedAt = &started
+	if err := q.store.Save(job); err != nil {
+		slog.ErrorContext(ctx, "failed to save pdf job status", "job_id", id, "error", err)
+	}
+
+	out, err := renderPDF(ctx, job.Request)
+	if err == nil {
+		err = q.store.SaveResult(id, out.PDF)
+	}
+
+	// The payload can hold personal data and isn't needed once rendered
+	job.Request = nil
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "pdf job failed", "job_id", id, "error", err)
+	} else {
+		sum := sha256.Sum256(out.PDF)
+		job.Status = JobDone
+		job.Filename = out.Filename
+		job.Size = len(out.PDF)
+		job.SHA256 = hex.EncodeToString(sum[:])
+		job.ResourceErrors = out.ResourceErrors
+		if out.stored != nil {
+			job.TemplateFile = out.stored.Filename
+			job.TemplateVersion = out.stored.Version
+		}
+		slog.InfoContext(ctx, "pdf job done", "job_id", id, "bytes", job.Size, "duration_ms", finished.Sub(started).Milliseconds())
+	}
+	if err := q.store.Save(job); err != nil {
+		slog.ErrorContext(ctx, "failed to save pdf job status", "job_id", id, "error", err)
+	}
+
+	if job.Callback != nil {
+		var pdf []byte
+		if out != nil {
+			pdf = out.PDF
+		}
+		q.deliveries.Add(1)
+		go q.notify(job, pdf)
+	}
+}
+
+// notify delivers the completion webhook of a finished job, retrying with
+// exponential backoff and recording every attempt on the job
+func (q *jobQueue) notify(job *Job, pdf []byte) {
+	defer q.deliveries.Done()
+
+	ctx := job.context()
+	secret := q.webhooks.secretFor(job.Callback)
+	for len(job.Callback.Attempts) < q.webhooks.cfg.MaxAttempts {
+		if retry := len(job.Callback.Attempts); retry > 0 {
+			select {
+			case <-time.After(q.webhooks.backoff(retry)):
+			case <-q.done:
+				return
+			}
+		}
+
+		payload := WebhookPayload{
+			JobID:    job.ID,
+			Status:   job.Status,
+			Filename: job.Filename,
+			Size:     job.Size,
+			SHA256:   job.SHA256,
+			Error:    job.Error,
+			SentAt:   time.Now().UTC(),
+
+			ResourceErrors: job.ResourceErrors,
+		}
+		if job.Status == JobDone {
+			payload.DownloadURL = q.webhooks.downloadURL(job.ID)
+			if job.Callback.Inline {
+				payload.PDFBase64 = base64.StdEncoding.EncodeToString(pdf)
+			}
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to encode webhook", "job_id", job.ID, "error", err)
+			return
+		}
+
+		status, err := q.webhooks.send(ctx, job.Callback.URL, secret, body)
+		attempt := CallbackAttempt{At: payload.SentAt, StatusCode: status}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		job.Callback.Attempts = append(job.Callback.Attempts, attempt)
+		job.Callback.Delivered = err == nil
+		if job.Callback.Delivered || len(job.Callback.Attempts) >= q.webhooks.cfg.MaxAttempts {
+			// No attempts are left to sign
+			job.Callback.secret = ""
+		}
+		if err := q.store.Save(job); err != nil {
+			slog.ErrorContext(ctx, "failed to save callback status", "job_id", job.ID, "error", err)
+		}
+
+		if err == nil {
+			slog.InfoContext(ctx, "webhook delivered", "job_id", job.ID, "url", job.Callback.URL)
+			return
+		}
+		slog.WarnContext(ctx, "webhook attempt failed", "job_id", job.ID, "attempt", len(job.Callback.Attempts), "error", err)
+	}
+	slog.ErrorContext(ctx, "giving up on webhook", "job_id", job.ID, "attempts", len(job.Callback.Attempts))
+}
+
+// recoverJobs re-queues jobs that were queued or running when the server last stopped
+func (q *jobQueue) recoverJobs() {
+	list, err := q.store.List()
+	if err != nil {
+		slog.Error("failed to list stored jobs", "error", err)
+		return
+	}
+
+	for _, job := range list {
+		if job.Status == JobDone || job.Status == JobFailed {
+			q.resumeCallback(job)
+			continue
+		}
+		job.Status = JobQueued
+		job.StartedAt = nil
+		if err := q.store.Save(job); err != nil {
+			slog.ErrorContext(job.context(), "failed to save pdf job status", "job_id", job.ID, "error", err)
+			continue
+		}
+		select {
+		case q.pending <- job.ID:
+			slog.InfoContext(job.context(), "re-queued pdf job from previous run", "job_id", job.ID)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// resumeCallback retries an undelivered webhook of a job finished before a restart
+func (q *jobQueue) resumeCallback(job *Job) {
+	if job.Callback == nil || job.Callback.Delivered || len(job.Callback.Attempts) >= q.webhooks.cfg.MaxAttempts {
+		return
+	}
+
+	var pdf []byte
+	if job.Status == JobDone && job.Callback.Inline {
+		var err error
+		if pdf, err = q.store.Result(job.ID); err != nil {
+			slog.ErrorContext(job.context(), "failed to load result for webhook", "job_id", job.ID, "error", err)
+			return
+		}
+	}
+	q.deliveries.Add(1)
+	go q.notify(job, pdf)
+}
+
+// janitor deletes finished jobs older than the result TTL
+func (q *jobQueue) janitor() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+
+		list, err := q.store.List()
+		if err != nil {
+			slog.Error("failed to list stored jobs", "error", err)
+			continue
+		}
+		cutoff := time.Now().Add(-q.cfg.ResultTTL)
+		for _, job := range list {
+			if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+				if err := q.store.Delete(job.ID); err != nil {
+					slog.Error("failed to delete expired job", "job_id", job.ID, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Close stops accepting jobs and waits for running jobs and in-flight webhook
+// attempts to finish. Jobs still queued and webhooks still to be retried stay
+// in the store and are picked up again on the next start when using the disk store.
+func (q *jobQueue) Close(ctx context.Context) error {
+	q.closeOnce.Do(func() { close(q.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		q.deliveries.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for running jobs: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobsOwnedBySubmitter(t *testing.T) {
+	q, err := newJobQueue(JobsConfig{QueueSize: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := jobs
+	jobs = q
+	t.Cleanup(func() { jobs = prev })
+
+	as := func(id string) context.Context {
+		return context.WithValue(context.Background(), authClientKey{}, &authClient{ID: id, Scopes: []string{ScopeRender}})
+	}
+	job, err := q.submit(as("crm"), &PDFRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ClientID != "crm" {
+		t.Fatalf("job client = %q, want crm", job.ClientID)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		handler http.HandlerFunc
+		path    string
+		want    int
+	}{
+		{"status for the submitter", as("crm"), handleJobStatus, "/jobs/" + job.ID, http.StatusOK},
+		{"status for another client", as("billing"), handleJobStatus, "/jobs/" + job.ID, http.StatusNotFound},
+		{"result for the submitter", as("crm"), handleJobResult, "/jobs/" + job.ID + "/result", http.StatusConflict},
+		{"result for another client", as("billing"), handleJobResult, "/jobs/" + job.ID + "/result", http.StatusNotFound},
+		{"status without authentication", context.Background(), handleJobStatus, "/jobs/" + job.ID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(tt.ctx, http.MethodGet, tt.path, nil)
+			r.SetPathValue("id", job.ID)
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
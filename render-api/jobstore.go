@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errJobNotFound is returned when a job or its result doesn't exist
+var errJobNotFound = errors.New("job not found")
+
+// errJobCorrupt is returned when a stored job can't be decoded
+var errJobCorrupt = errors.New("corrupt job file")
+
+// JobStore persists asynchronous jobs and their results
+type JobStore interface {
+	// Save creates or updates a job
+	Save(job *Job) error
+	// Get returns a copy of a job
+	Get(id string) (*Job, error)
+	// List returns all jobs, oldest first
+	List() ([]*Job, error)
+	// SaveResult stores the PDF produced by a job
+	SaveResult(id string, pdf []byte) error
+	// Result returns the PDF produced by a job
+	Result(id string) ([]byte, error)
+	// Delete removes a job and its result
+	Delete(id string) error
+}
+
+// newJobStore creates the job store selected in config
+func newJobStore(cfg JobsConfig) (JobStore, error) {
+	switch cfg.Store {
+	case "", "memory":
+		return newMemoryJobStore(), nil
+	case "disk":
+		return newDiskJobStore(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown job store %q (use memory or disk)", cfg.Store)
+	}
+}
+
+// memoryJobStore keeps jobs in memory; they are lost on restart
+type memoryJobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	results map[string][]byte
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs:    make(map[string]*Job),
+		results: make(map[string][]byte),
+	}
+}
+
+func (s *memoryJobStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job.clone()
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return job.clone(), nil
+}
+
+func (s *memoryJobStore) List() ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job.clone())
+	}
+	sortJobs(jobs)
+	return jobs, nil
+}
+
+func (s *memoryJobStore) SaveResult(id string, pdf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = pdf
+	return nil
+}
+
+func (s *memoryJobStore) Result(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pdf, ok := s.results[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return pdf, nil
+}
+
+func (s *memoryJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	delete(s.results, id)
+	return nil
+}
+
+// diskJobStore keeps each job as <id>.json and its result as <id>.pdf in a
+// directory, so queued jobs survive a restart. A webhook's callback secret is
+// kept in <id>.secret instead of the job, and removed once delivery is over.
+// Files are only readable by the server's user: a queued job holds its
+// request payload in plaintext until it finishes.
+type diskJobStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newDiskJobStore(dir string) (*diskJobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %w", err)
+	}
+	return &diskJobStore{dir: dir}, nil
+}
+
+func (s *diskJobStore) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+func (s *diskJobStore) Save(job *Job) error {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secretPath := s.path(job.ID, ".secret")
+	if job.Callback != nil && job.Callback.secret != "" {
+		if err := writeFileAtomic(secretPath, []byte(job.Callback.secret), 0600); err != nil {
+			return err
+		}
+	} else if err := os.Remove(secretPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(s.path(job.ID, ".json"), content, 0600)
+}
+
+func (s *diskJobStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(s.path(id, ".json"))
+}
+
+func (s *diskJobStore) read(path string) (*Job, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errJobNotFound
+		}
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(content, &job); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errJobCorrupt, filepath.Base(path), err)
+	}
+	if job.Callback != nil {
+		secret, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".secret")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		job.Callback.secret = string(secret)
+	}
+	return &job, nil
+}
+
+func (s *diskJobStore) List() ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		// One unreadable job mustn't hide the others. Corrupt files are moved
+		// aside for inspection so they aren't reported on every call.
+		path := filepath.Join(s.dir, entry.Name())
+		job, err := s.read(path)
+		if errors.Is(err, errJobCorrupt) {
+			quarantined := path + ".corrupt"
+			if renameErr := os.Rename(path, quarantined); renameErr != nil {
+				slog.Error("failed to move aside corrupt job file", "file", entry.Name(), "error", renameErr)
+			} else {
+				slog.Error("moved aside corrupt job file", "file", filepath.Base(quarantined), "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			slog.Error("skipping unreadable job file", "file", entry.Name(), "error", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sortJobs(jobs)
+	return jobs, nil
+}
+
+func (s *diskJobStore) SaveResult(id string, pdf []byte) error {
+	return writeFileAtomic(s.path(id, ".pdf"), pdf, 0600)
+}
+
+func (s *diskJobStore) Result(id string) ([]byte, error) {
+	pdf, err := os.ReadFile(s.path(id, ".pdf"))
+	if os.IsNotExist(err) {
+		return nil, errJobNotFound
+	}
+	return pdf, err
+}
+
+func (s *diskJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ext := range []string{".json", ".secret", ".pdf"} {
+		if err := os.Remove(s.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortJobs orders jobs by creation time, oldest first
+func sortJobs(jobs []*Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskJobStoreCallbackSecret(t *testing.T) {
+	store, err := newDiskJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &Job{
+		ID:        "9c7026baa3c42a6f6a4d13643bf79500",
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+		Callback:  &CallbackState{URL: "https://crm.example.com/hook", secret: "s3cret"},
+		Request:   &PDFRequest{CallbackURL: "https://crm.example.com/hook"},
+	}
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(store.path(job.ID, ".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "s3cret") {
+		t.Errorf("job file holds the callback secret: %s", content)
+	}
+	if info, err := os.Stat(store.path(job.ID, ".secret")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("secret file: %v, %v", info, err)
+	}
+
+	got, err := store.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Callback.secret != "s3cret" {
+		t.Errorf("loaded secret = %q, want s3cret", got.Callback.secret)
+	}
+
+	// Clearing the secret once delivery is over removes its file
+	got.Callback.secret = ""
+	if err := store.Save(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.path(job.ID, ".secret")); !os.IsNotExist(err) {
+		t.Errorf("secret file still exists: %v", err)
+	}
+}
+
+func TestDiskJobStoreListSkipsCorruptJobs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := &Job{ID: "9c7026baa3c42a6f6a4d13643bf79500", Status: JobDone, CreatedAt: time.Now().UTC()}
+	if err := store.Save(good); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "0123456789abcdef0123456789abcdef.json")
+	if err := os.WriteFile(corrupt, []byte(`{"id":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != good.ID {
+		t.Errorf("List returned %d jobs, want only %s", len(list), good.ID)
+	}
+	if _, err := os.Stat(corrupt + ".corrupt"); err != nil {
+		t.Errorf("corrupt job file wasn't moved aside: %v", err)
+	}
+}
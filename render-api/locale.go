@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Indonesian month and weekday names used by formatDate
+var (
+	idMonths      = [...]string{"Januari", "Februari", "Maret", "April", "Mei", "Juni", "Juli", "Agustus", "September", "Oktober", "November", "Desember"}
+	idMonthsShort = [...]string{"Jan", "Feb", "Mar", "Apr", "Mei", "Jun", "Jul", "Agu", "Sep", "Okt", "Nov", "Des"}
+	idWeekdays    = [...]string{"Minggu", "Senin", "Selasa", "Rabu", "Kamis", "Jumat", "Sabtu"}
+	idWeekdaysAbr = [...]string{"Min", "Sen", "Sel", "Rab", "Kam", "Jum", "Sab"}
+)
+
+// defaultDateLayout renders dates like "10 Februari 2026"
+const defaultDateLayout = "2 January 2006"
+
+// dateInputLayouts are the ISO-style layouts accepted from payloads
+var dateInputLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// thousandsPattern matches numbers grouped with Indonesian thousands dots, e.g. 80.000.000
+var thousandsPattern = regexp.MustCompile(`^\d{1,3}(\.\d{3})+$`)
+
+// toFloat converts a payload value to a number. Strings may use Indonesian
+// formatting ("Rp 1.234.567,50") or plain decimals ("1234567.5").
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	case string:
+		return parseNumberID(n)
+	default:
+		return 0, fmt.Errorf("cannot convert %T to a number", v)
+	}
+}
+
+// parseNumberID parses a numeric string, accepting Indonesian thousands dots
+// and decimal comma. A dot followed by groups of exactly three digits is read
+// as a thousands separator, so "1.500" is 1500 and "12.500.000" is 12500000,
+// while "1.5" and "1.50" are decimals. Payloads that send English decimals
+// with three places must use a number, not a string.
+func parseNumberID(s string) (float64, error) {
+	clean := strings.TrimSpace(s)
+	clean = strings.TrimPrefix(clean, "Rp")
+	clean = strings.TrimPrefix(clean, ".")
+	clean = strings.ReplaceAll(clean, " ", "")
+
+	switch {
+	case strings.Contains(clean, ","):
+		clean = strings.ReplaceAll(clean, ".", "")
+		clean = strings.ReplaceAll(clean, ",", ".")
+	case thousandsPattern.MatchString(strings.TrimPrefix(clean, "-")):
+		clean = strings.ReplaceAll(clean, ".", "")
+	}
+
+	f, err := strconv.ParseFloat(clean, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return f, nil
+}
+
+// isBlank reports whether a template argument is missing or empty
+func isBlank(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	s, ok := v.(string)
+	return ok && strings.TrimSpace(s) == ""
+}
+
+// roundDecimal formats a non-negative number with the given number of
+// decimals, rounding half up on its shortest decimal form. Rounding the
+// binary value instead would turn 1.005 into 1.00, since the nearest float64
+// is slightly below it.
+func roundDecimal(f float64, decimals int) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if len(fracPart) <= decimals {
+		fracPart += strings.Repeat("0", decimals-len(fracPart))
+	} else {
+		up := fracPart[decimals] >= '5'
+		digits := []byte(intPart + fracPart[:decimals])
+		for i := len(digits) - 1; up && i >= 0; i-- {
+			if digits[i] == '9' {
+				digits[i] = '0'
+			} else {
+				digits[i]++
+				up = false
+			}
+		}
+		if up {
+			digits = append([]byte{'1'}, digits...)
+		}
+		intPart, fracPart = string(digits[:len(digits)-decimals]), string(digits[len(digits)-decimals:])
+	}
+	if decimals == 0 {
+		return intPart
+	}
+	return intPart + "." + fracPart
+}
+
+// groupThousands formats a non-negative number with dot thousands separators
+// and a comma before the given number of decimals
+func groupThousands(f float64, decimals int) string {
+	s := roundDecimal(f, decimals)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+
+	var b strings.Builder
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteByte('.')
+		}
+		b.WriteRune(c)
+	}
+	if fracPart != "" {
+		b.WriteByte(',')
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
+
+// formatNumberID formats a number the Indonesian way: 1.234.567 or 1.234,50
+// with optional decimals
+func formatNumberID(v interface{}, decimals ...int) (string, error) {
+	if isBlank(v) {
+		return "", nil
+	}
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	d := 0
+	if len(decimals) > 0 {
+		d = decimals[0]
+	}
+	if f < 0 {
+		return "-" + groupThousands(-f, d), nil
+	}
+	return groupThousands(f, d), nil
+}
+
+// formatRupiah formats an amount as "Rp 1.234.567,00"; decimals default to 2
+func formatRupiah(v interface{}, decimals ...int) (string, error) {
+	if isBlank(v) {
+		return "", nil
+	}
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	d := 2
+	if len(decimals) > 0 {
+		d = decimals[0]
+	}
+	if f < 0 {
+		return "-Rp " + groupThousands(-f, d), nil
+	}
+	return "Rp " + groupThousands(f, d), nil
+}
+
+// terbilang spells out the integer part of an amount in Indonesian words,
+// e.g. 1250000 -> "satu juta dua ratus lima puluh ribu"
+func terbilang(v interface{}) (string, error) {
+	if isBlank(v) {
+		return "", nil
+	}
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	if math.Abs(f) >= 1e18 {
+		return "", fmt.Errorf("terbilang: %v is too large", v)
+	}
+
+	n := int64(math.Trunc(f))
+	if n == 0 {
+		return "nol", nil
+	}
+	if n < 0 {
+		return "minus " + spellID(-n), nil
+	}
+	return spellID(n), nil
+}
+
+// spellID spells out a positive integer in Indonesian
+func spellID(n int64) string {
+	digits := [...]string{"", "satu", "dua", "tiga", "empat", "lima", "enam", "tujuh", "delapan", "sembilan", "sepuluh", "sebelas"}
+
+	var words string
+	switch {
+	case n < 12:
+		words = digits[n]
+	case n < 20:
+		words = spellID(n-10) + " belas"
+	case n < 100:
+		words = spellID(n/10) + " puluh " + spellID(n%10)
+	case n < 200:
+		words = "seratus " + spellID(n-100)
+	case n < 1000:
+		words = spellID(n/100) + " ratus " + spellID(n%100)
+	case n < 2000:
+		words = "seribu " + spellID(n-1000)
+	case n < 1_000_000:
+		words = spellID(n/1000) + " ribu " + spellID(n%1000)
+	case n < 1_000_000_000:
+		words = spellID(n/1_000_000) + " juta " + spellID(n%1_000_000)
+	case n < 1_000_000_000_000:
+		words = spellID(n/1_000_000_000) + " miliar " + spellID(n%1_000_000_000)
+	case n < 1_000_000_000_000_000:
+		words = spellID(n/1_000_000_000_000) + " triliun " + spellID(n%1_000_000_000_000)
+	default:
+		words = spellID(n/1_000_000_000_000_000) + " kuadriliun " + spellID(n%1_000_000_000_000_000)
+	}
+	return strings.TrimSpace(words)
+}
+
+// parseDate parses an ISO date or timestamp from a payload
+func parseDate(v interface{}) (time.Time, bool) {
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	s = strings.TrimSpace(s)
+	for _, layout := range dateInputLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// formatDateID formats an ISO date with Indonesian month and day names using
+// a Go layout (default "2 January 2006" -> "10 Februari 2026"). Values that
+// aren't ISO dates are returned unchanged so pre-formatted strings still render.
+func formatDateID(v interface{}, layout ...string) string {
+	if isBlank(v) {
+		return ""
+	}
+	t, ok := parseDate(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	l := defaultDateLayout
+	if len(layout) > 0 && layout[0] != "" {
+		l = layout[0]
+	}
+
+	// Replace name tokens with Indonesian names and format the rest with Go
+	var b strings.Builder
+	for l != "" {
+		switch {
+		case strings.HasPrefix(l, "January"):
+			b.WriteString(idMonths[t.Month()-1])
+			l = l[len("January"):]
+		case strings.HasPrefix(l, "Jan"):
+			b.WriteString(idMonthsShort[t.Month()-1])
+			l = l[len("Jan"):]
+		case strings.HasPrefix(l, "Monday"):
+			b.WriteString(idWeekdays[t.Weekday()])
+			l = l[len("Monday"):]
+		case strings.HasPrefix(l, "Mon"):
+			b.WriteString(idWeekdaysAbr[t.Weekday()])
+			l = l[len("Mon"):]
+		default:
+			end := nextNameToken(l)
+			b.WriteString(t.Format(l[:end]))
+			l = l[end:]
+		}
+	}
+	return b.String()
+}
+
+// nextNameToken returns the index of the next month or weekday name token in a layout
+func nextNameToken(layout string) int {
+	end := len(layout)
+	for _, tok := range []string{"Jan", "Mon"} {
+		if i := strings.Index(layout[1:], tok); i >= 0 && i+1 < end {
+			end = i + 1
+		}
+	}
+	return end
+}
+
+// digitsOnly strips everything but digits from s
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// formatNPWP formats a 15-digit NPWP as 02.990.493.9-344.856; 16-digit
+// (NIK-based) NPWPs and other values are returned unchanged
+func formatNPWP(v interface{}) string {
+	if isBlank(v) {
+		return ""
+	}
+	s := fmt.Sprint(v)
+	d := digitsOnly(s)
+	if len(d) != 15 {
+		return s
+	}
+	return fmt.Sprintf("%s.%s.%s.%s-%s.%s", d[0:2], d[2:5], d[5:8], d[8:9], d[9:12], d[12:15])
+}
+
+// formatPhoneID formats an Indonesian number like 628123123123 or 08123123123
+// as +62 812-3123-123; other values are returned unchanged
+func formatPhoneID(v interface{}) string {
+	if isBlank(v) {
+		return ""
+	}
+	s := fmt.Sprint(v)
+	d := digitsOnly(s)
+	switch {
+	case strings.HasPrefix(d, "62"):
+		d = d[2:]
+	case strings.HasPrefix(d, "0"):
+		d = d[1:]
+	default:
+		return s
+	}
+	if len(d) < 6 {
+		return s
+	}
+
+	groups := []string{d[:3]}
+	for rest := d[3:]; rest != ""; {
+		n := min(4, len(rest))
+		groups = append(groups, rest[:n])
+		rest = rest[n:]
+	}
+	return "+62 " + strings.Join(groups, "-")
+}
+
+// floatOp applies a binary operation to two numeric template arguments
+func floatOp(a, b interface{}, op func(x, y float64) float64) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
+
+// roundTo rounds a number half away from zero to the given number of
+// decimal places
+func roundTo(v interface{}, places int) (float64, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	if places < 0 {
+		p := math.Pow(10, float64(-places))
+		return math.Round(f/p) * p, nil
+	}
+	r, err := strconv.ParseFloat(roundDecimal(math.Abs(f), places), 64)
+	return math.Copysign(r, f), err
+}
+
+// errDivideByZero fails a template that divides by zero rather than letting
+// it print a made-up amount
+var errDivideByZero = errors.New("divf: division by zero")
+
+// divideFloat divides two numeric template arguments
+func divideFloat(a, b interface{}) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	if y == 0 {
+		return 0, errDivideByZero
+	}
+	return x / y, nil
+}
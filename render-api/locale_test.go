@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"testing"
+	"time"
+)
+
+func TestTerbilang(t *testing.T) {
+	for _, tt := range []struct {
+		in   interface{}
+		want string
+	}{
+		{0, "nol"},
+		{1, "satu"},
+		{10, "sepuluh"},
+		{11, "sebelas"},
+		{12, "dua belas"},
+		{19, "sembilan belas"},
+		{20, "dua puluh"},
+		{21, "dua puluh satu"},
+		{100, "seratus"},
+		{111, "seratus sebelas"},
+		{999, "sembilan ratus sembilan puluh sembilan"},
+		{1000, "seribu"},
+		{1100, "seribu seratus"},
+		{2000, "dua ribu"},
+		{10_000, "sepuluh ribu"},
+		{1_250_000, "satu juta dua ratus lima puluh ribu"},
+		{1e6, "satu juta"},
+		{1_001_000, "satu juta seribu"},
+		{1e9, "satu miliar"},
+		{1e12, "satu triliun"},
+		{2e15, "dua kuadriliun"},
+		{-15, "minus lima belas"},
+		{-1e6, "minus satu juta"},
+		{999.995, "sembilan ratus sembilan puluh sembilan"}, // only the integer part
+		{"Rp 1.500", "seribu lima ratus"},
+		{"", ""},
+	} {
+		got, err := terbilang(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("terbilang(%v) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []interface{}{1e18, -1e18, "abc", true} {
+		if got, err := terbilang(in); err == nil {
+			t.Errorf("terbilang(%v) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestFormatRupiah(t *testing.T) {
+	for _, tt := range []struct {
+		in       interface{}
+		decimals []int
+		want     string
+	}{
+		{0, nil, "Rp 0,00"},
+		{1234567, nil, "Rp 1.234.567,00"},
+		{1234567, []int{0}, "Rp 1.234.567"},
+		{1234567.5, []int{0}, "Rp 1.234.568"},
+		{100, nil, "Rp 100,00"},
+		{1000, nil, "Rp 1.000,00"},
+		{1e12, []int{0}, "Rp 1.000.000.000.000"},
+		{-1500, nil, "-Rp 1.500,00"},
+		{999.995, nil, "Rp 1.000,00"},
+		{999.994, nil, "Rp 999,99"},
+		{1.005, nil, "Rp 1,01"}, // the float64 is just below 1.005
+		{0.125, nil, "Rp 0,13"},
+		{"Rp 80.000.000", nil, "Rp 80.000.000,00"},
+		{"1.234,5", nil, "Rp 1.234,50"},
+		{"", nil, ""},
+	} {
+		got, err := formatRupiah(tt.in, tt.decimals...)
+		if err != nil || got != tt.want {
+			t.Errorf("formatRupiah(%v, %v) = %q, %v; want %q", tt.in, tt.decimals, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []interface{}{"abc", "NaN", "Inf", []int{1}} {
+		if got, err := formatRupiah(in); err == nil {
+			t.Errorf("formatRupiah(%v) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestParseNumberID(t *testing.T) {
+	for in, want := range map[string]float64{
+		"1500":            1500,
+		"1.500":           1500, // thousands dot, not 1.5
+		"12.500.000":      12_500_000,
+		"-1.500":          -1500,
+		"1.5":             1.5,
+		"1.50":            1.5,
+		"1.5000":          1.5,
+		"1,5":             1.5,
+		"1.234.567,50":    1234567.5,
+		"Rp 1.234.567,50": 1234567.5,
+		"Rp.1.500":        1500,
+		" 1 500 ":         1500,
+		"1234567.5":       1234567.5,
+	} {
+		got, err := parseNumberID(in)
+		if err != nil || got != want {
+			t.Errorf("parseNumberID(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "1.2.3", "1,2,3", "NaN", "inf", "Rp"} {
+		if got, err := parseNumberID(in); err == nil {
+			t.Errorf("parseNumberID(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	for _, tt := range []struct {
+		in     interface{}
+		places int
+		want   float64
+	}{
+		{1.005, 2, 1.01},
+		{2.675, 2, 2.68},
+		{-2.675, 2, -2.68},
+		{999.995, 2, 1000},
+		{411522.333, 2, 411522.33},
+		{1250, -2, 1300},
+		{"1.234,567", 2, 1234.57},
+	} {
+		got, err := roundTo(tt.in, tt.places)
+		if err != nil || got != tt.want {
+			t.Errorf("roundTo(%v, %d) = %v, %v; want %v", tt.in, tt.places, got, err, tt.want)
+		}
+	}
+}
+
+func TestDivf(t *testing.T) {
+	if got, err := divideFloat("Rp 1.000", 4); err != nil || got != 250 {
+		t.Errorf("divideFloat = %v, %v; want 250", got, err)
+	}
+	if _, err := divideFloat(1, "0"); !errors.Is(err, errDivideByZero) {
+		t.Errorf("divide by zero: got %v", err)
+	}
+
+	// The template fails instead of printing "Rp 0,00"
+	tmpl := template.Must(template.New("t").Funcs(templateFuncMap).Parse(`{{rupiah (divf .total .count)}}`))
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{"total": 1000, "count": 0})
+	if !errors.Is(err, errDivideByZero) {
+		t.Errorf("template with a zero divisor: %q, %v", buf.String(), err)
+	}
+}
+
+func TestFormatDateID(t *testing.T) {
+	jakarta := time.FixedZone("WIB", 7*3600)
+	for _, tt := range []struct {
+		in     interface{}
+		layout []string
+		want   string
+	}{
+		{"2026-02-10", nil, "10 Februari 2026"},
+		{"2026-12-01", nil, "1 Desember 2026"},
+		{"2026-02-10T14:05:00+07:00", []string{"Monday, 2 Jan 2006 15:04"}, "Selasa, 10 Feb 2026 14:05"},
+		{"2026-02-15 08:00:00", []string{"Mon 02/01/2006"}, "Min 15/02/2026"},
+		{"2026-08-17", []string{"Monday, 2 January 2006"}, "Senin, 17 Agustus 2026"},
+		{"2026-05-01", []string{"January 2006"}, "Mei 2026"},
+		{"2026-02-10", []string{""}, "10 Februari 2026"},
+		{time.Date(2026, 3, 6, 9, 30, 0, 0, jakarta), []string{"2 Jan 2006 15:04 MST"}, "6 Mar 2026 09:30 WIB"},
+		{"10/02/2026", nil, "10/02/2026"}, // not ISO: unchanged
+		{"kemarin", nil, "kemarin"},
+		{"", nil, ""},
+		{nil, nil, ""},
+	} {
+		if got := formatDateID(tt.in, tt.layout...); got != tt.want {
+			t.Errorf("formatDateID(%v, %v) = %q, want %q", tt.in, tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestFormatNPWP(t *testing.T) {
+	for in, want := range map[string]string{
+		"029904939344856":      "02.990.493.9-344.856",
+		"02.990.493.9-344.856": "02.990.493.9-344.856",
+		"02 990 493 9 344 856": "02.990.493.9-344.856",
+		"3174012345670001":     "3174012345670001", // 16-digit NIK-based NPWP
+		"12345":                "12345",
+		"":                     "",
+	} {
+		if got := formatNPWP(in); got != want {
+			t.Errorf("formatNPWP(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFormatPhoneID(t *testing.T) {
+	for in, want := range map[string]string{
+		"628123123123":     "+62 812-3123-123",
+		"08123123123":      "+62 812-3123-123",
+		"+62 812 3123 123": "+62 812-3123-123",
+		"0812-3123-1234":   "+62 812-3123-1234",
+		"02150001234":      "+62 215-0001-234",
+		"0812":             "0812", // too short
+		"+1 415 555 0100":  "+1 415 555 0100",
+		"":                 "",
+	} {
+		if got := formatPhoneID(in); got != want {
+			t.Errorf("formatPhoneID(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,24 +1,132 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"log/slog"
 	"net/http"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	flag.Parse()
+	initConfig()
+
+	// OpenTelemetry tracing
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+
+	// Remove temp files left by a previous crash
+	sweepTempFiles()
+
+	// Shared headless Chrome pool for PDF rendering
+	pdfPool = newBrowserPool(config.Browser)
+	go pdfPool.warm()
+
+	// Parsed-template cache shared by the render handlers
+	tmplCache = newTemplateCache(config.TemplateCache)
+
+	// Outbound resource policy for rendered pages and image downloads
+	policy, err = newResourcePolicy(config.Resources)
+	if err != nil {
+		fatal("failed to set up resource policy", "error", err)
+	}
+
+	// Remote image pre-fetcher
+	images, err = newImageFetcher(config.Images, policy)
+	if err != nil {
+		fatal("failed to set up image pre-fetcher", "error", err)
+	}
+
+	// API authentication
+	authn, err = newAuthChain(config.Auth)
+	if err != nil {
+		fatal("failed to set up authentication", "error", err)
+	}
+	if authn == nil {
+		slog.Warn("authentication disabled (AUTH_CLIENTS_FILE and AUTH_JWKS_FILE not set)")
+	}
+
+	// Per-client rate limits and the concurrent render gate
+	limits = newLimiter(config.RateLimit)
+
+	// Asynchronous PDF job queue
+	jobs, err = newJobQueue(config.Jobs, newWebhookSender(config.Webhook, policy))
+	if err != nil {
+		fatal("failed to set up job queue", "error", err)
+	}
+	jobs.start()
+
+	// Readiness checks and Chrome version detection
+	ready = newReadiness(config.Health)
+
 	mux := http.NewServeMux()
 
+	// handle registers an API route behind tracing, request IDs, metrics,
+	// CORS, the per-IP rate limit, the body size limit, authentication and
+	// the route's rate limit
+	handle := func(route, scope string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, withTracing(route, withRequestID(withMetrics(route, withCORS(
+			withIPRateLimit(withBodyLimit(withAuth(scope, withRateLimit(route, handler)))))))))
+	}
+
 	// Template rendering
-	mux.HandleFunc("/render/html", withCORS(handleRenderHTML))
-	mux.HandleFunc("/render/pdf", withCORS(handleRenderPDF))
+	handle("/render/html", ScopeRender, handleRenderHTML)
+	handle("/render/pdf", ScopeRender, withRenderSlot(handleRenderPDF))
+	handle("/render/pdf/batch", ScopeRender, withRenderSlot(handleRenderBatch))
+
+	// Asynchronous PDF jobs
+	handle("/jobs/pdf", ScopeRender, handleSubmitJob)
+	handle("/jobs/{id}", ScopeRender, handleJobStatus)
+	handle("/jobs/{id}/result", ScopeRender, handleJobResult)
 
 	// Template management
-	mux.HandleFunc("/templates/save", withCORS(handleSaveTemplate))
-	mux.HandleFunc("/templates/list", withCORS(handleListTemplates))
-	mux.HandleFunc("/templates/upload-dms", withCORS(handleUploadDMS))
+	handle("/templates/save", ScopeSave, handleSaveTemplate)
+	handle("/templates/list", ScopeRender, handleListTemplates)
+	handle("/templates/{name}/versions/{v}", ScopeRender, handleGetTemplateVersion)
+	handle("/templates/{name}/diff", ScopeRender, handleDiffTemplate)
+	handle("/templates/{name}/versions/{v}/archive", ScopeSave, handleArchiveTemplate)
+	handle("/templates/{name}/versions/{v}/restore", ScopeSave, handleRestoreTemplate)
+	handle("/templates/{name}/versions/{v}/publish", ScopePublish, handlePublishTemplate)
+	handle("/templates/upload-dms", ScopeUploadDMS, handleUploadDMS)
+	handle("/templates/cache", ScopeAdmin, handleCacheStats)
 
-	log.Printf("render-api listening on %s", config.ServerAddr)
-	if err := http.ListenAndServe(config.ServerAddr, mux); err != nil {
-		log.Fatal(err)
+	// Rate limiter and render gate usage
+	handle("/limits", ScopeAdmin, handleLimitStats)
+
+	// Health and build information. Liveness and readiness probes aren't
+	// authenticated, rate limited or logged.
+	mux.HandleFunc("/healthz", withCORS(handleHealthz))
+	mux.HandleFunc("/readyz", withCORS(handleReadyz))
+	handle("/version", ScopeRender, handleVersion)
+
+	servers := []*http.Server{newServer(config.Server.Addr, mux, config.Server)}
+
+	// Prometheus metrics, on their own listener when METRICS_ADDR is set so
+	// they can stay off the public port
+	if config.Server.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsServer := newServer(config.Server.MetricsAddr, metricsMux, config.Server)
+		servers = append(servers, metricsServer)
+		serve("metrics", metricsServer)
+	} else {
+		mux.HandleFunc("/metrics", withIPRateLimit(withAuth(ScopeAdmin, promhttp.Handler().ServeHTTP)))
 	}
+
+	// Apply CORS, rate limit and log level changes without a restart
+	go watchConfig()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	serve("render-api", servers[0])
+	<-ctx.Done()
+
+	// A second signal exits at once
+	stop()
+	shutdown(servers, shutdownTracing)
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Template version statuses. Versions are saved as drafts or approved;
+// publishing one makes it the version "latest" renders and deprecates the
+// version published before it.
+const (
+	StatusDraft      = "draft"
+	StatusApproved   = "approved"
+	StatusPublished  = "published"
+	StatusDeprecated = "deprecated"
+)
+
+// publishMu serializes publishes so two can't both leave a version published
+var publishMu sync.Mutex
+
+// TemplateMeta is the metadata sidecar saved with each template version
+type TemplateMeta struct {
+	Author  string    `json:"author,omitempty"`
+	Message string    `json:"message,omitempty"` // why the version exists, like a commit message
+	Created time.Time `json:"created"`
+	SHA256  string    `json:"sha256"` // hex SHA-256 of the template file
+	Tags    []string  `json:"tags,omitempty"`
+	Status  string    `json:"status"`
+}
+
+// metaFilename returns the file name of the metadata sidecar of a template version
+func metaFilename(name string, version int) string {
+	if version == 0 {
+		return name + ".meta.json"
+	}
+	return fmt.Sprintf("%s-v%d.meta.json", name, version)
+}
+
+// newTemplateMeta describes a new version of template. Tags are trimmed and
+// lowercased, and empty or repeated ones dropped.
+func newTemplateMeta(template []byte, author, message string, tags []string, status string) *TemplateMeta {
+	sum := sha256.Sum256(template)
+	meta := &TemplateMeta{
+		Author:  strings.TrimSpace(author),
+		Message: strings.TrimSpace(message),
+		Created: time.Now().UTC(),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Status:  status,
+	}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(meta.Tags, tag) {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	return meta
+}
+
+// encode returns the sidecar file content of meta
+func (m *TemplateMeta) encode() ([]byte, error) {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode template metadata: %w", err)
+	}
+	return append(content, '\n'), nil
+}
+
+// hasTags reports whether meta carries every one of tags
+func (m *TemplateMeta) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(m.Tags, strings.ToLower(strings.TrimSpace(tag))) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeTemplateMeta parses a metadata sidecar; nil content returns nil
+func decodeTemplateMeta(content []byte) (*TemplateMeta, error) {
+	if content == nil {
+		return nil, nil
+	}
+	var meta TemplateMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return nil, fmt.Errorf("invalid template metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// readTemplateMeta reads the metadata of a template version in dir. Versions
+// saved before metadata was recorded have none and return nil.
+func readTemplateMeta(dir, name string, version int) (*TemplateMeta, error) {
+	filename := metaFilename(name, version)
+	content, err := os.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	meta, err := decodeTemplateMeta(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return meta, nil
+}
+
+// writeTemplateMeta replaces the metadata of a stored template version
+func writeTemplateMeta(name string, version int, meta *TemplateMeta) error {
+	content, err := meta.encode()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(config.TemplatesDir, metaFilename(name, version)), content, 0644)
+}
+
+// publishedFilename returns the file name of a template's published pointer,
+// which holds the number of the version "latest" renders
+func publishedFilename(name string) string {
+	return name + ".published"
+}
+
+// readPublishedPointer returns the version a template's published pointer
+// names, if it has one
+func readPublishedPointer(name string) (int, bool, error) {
+	filename := publishedFilename(name)
+	content, err := os.ReadFile(filepath.Join(config.TemplatesDir, filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || v < 0 {
+		return 0, false, fmt.Errorf("%s: invalid version %q", filename, strings.TrimSpace(string(content)))
+	}
+	return v, true, nil
+}
+
+// publishedVersion returns the published version of a template, if it is
+// one of versions. It costs one small file read, so renders of "latest" call
+// it every time; a published version that was archived since is ignored.
+func publishedVersion(name string, versions []int) (int, bool, error) {
+	v, ok, err := readPublishedPointer(name)
+	if err != nil || !ok || !slices.Contains(versions, v) {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// reconcileStatus corrects the status in a version's metadata by the
+// published pointer, which is what renders follow: the version it names is
+// published and any other version still marked published, archived ones
+// included, is deprecated. A publish interrupted between moving the pointer
+// and updating the metadata leaves stale statuses until the next publish.
+func reconcileStatus(meta *TemplateMeta, name string, version int, archived bool) error {
+	if meta == nil {
+		return nil
+	}
+	published, ok, err := readPublishedPointer(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ok && !archived && version == published:
+		meta.Status = StatusPublished
+	case meta.Status == StatusPublished:
+		meta.Status = StatusDeprecated
+	}
+	return nil
+}
+
+// publishTemplate makes a stored version the published one and deprecates
+// the version published before it, returning the new metadata. A version saved
+// without metadata gets it now, dated by its file.
+//
+// The published pointer is replaced atomically first, so a crash leaves
+// either the old or the new version published, never both or none. The
+// metadata is updated after it, and reconcileStatus covers a crash in between.
+func publishTemplate(st *storedTemplate) (*TemplateMeta, error) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	meta, err := readTemplateMeta(config.TemplatesDir, st.Name, st.Version)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		content, err := readTemplateFile(st.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template file: %w", err)
+		}
+		meta = newTemplateMeta(content, "", "", nil, StatusPublished)
+		meta.Created = st.ModTime.UTC()
+	}
+	meta.Status = StatusPublished
+
+	pointer := filepath.Join(config.TemplatesDir, publishedFilename(st.Name))
+	if err := writeFileAtomic(pointer, []byte(strconv.Itoa(st.Version)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err := writeTemplateMeta(st.Name, st.Version, meta); err != nil {
+		return nil, err
+	}
+
+	// Every other version still marked published is deprecated, which also
+	// tidies up after a publish that was interrupted
+	versions, err := templateVersions(st.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+	for _, v := range versions {
+		if v == st.Version {
+			continue
+		}
+		old, err := readTemplateMeta(config.TemplatesDir, st.Name, v)
+		if err != nil {
+			return nil, err
+		}
+		if old == nil || old.Status != StatusPublished {
+			continue
+		}
+		old.Status = StatusDeprecated
+		if err := writeTemplateMeta(st.Name, v, old); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "render_api"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+
+	templateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "template_duration_seconds",
+		Help:      "Template parse and execute time.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"op"})
+
+	pdfPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pdf_phase_duration_seconds",
+		Help:      "PDF generation time by phase: acquire (waiting for a browser), navigate, wait and print.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"phase"})
+
+	pdfRenders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pdf_renders_total",
+		Help:      "PDF generations by outcome (ok or error), including jobs and batch items.",
+	}, []string{"outcome"})
+
+	pdfSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pdf_size_bytes",
+		Help:      "Size of generated PDFs.",
+		Buckets:   prometheus.ExponentialBuckets(16<<10, 4, 8), // 16 KiB to 256 MiB
+	})
+
+	dmsUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dms_uploads_total",
+		Help:      "DMS template uploads by outcome (success, rejected or error) and DMS status code.",
+	}, []string{"outcome", "status"})
+
+	chromeProcesses = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "chrome_processes",
+		Help:      "Chrome processes currently running in the browser pool.",
+	})
+
+	chromeRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "chrome_restarts_total",
+		Help:      "Pooled Chrome restarts by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(statsCollector{})
+}
+
+// observeDuration records the time since start; use with defer
+func observeDuration(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withMetrics wraps a handler to count requests and observe their latency
+// under the route pattern it is registered with
+func withMetrics(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(rec.status)}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statsCollector exports the template cache, browser pool and rate limiter
+// statistics that are kept as snapshots rather than as metrics
+type statsCollector struct{}
+
+var (
+	cacheEntriesDesc   = prometheus.NewDesc(metricsNamespace+"_template_cache_entries", "Parsed templates in the cache.", nil, nil)
+	cacheBytesDesc     = prometheus.NewDesc(metricsNamespace+"_template_cache_bytes", "Template source bytes held by the cache.", nil, nil)
+	cacheLookupsDesc   = prometheus.NewDesc(metricsNamespace+"_template_cache_lookups_total", "Template cache lookups by result (hit or miss).", []string{"result"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(metricsNamespace+"_template_cache_evictions_total", "Templates evicted from the cache.", nil, nil)
+	cacheHitRateDesc   = prometheus.NewDesc(metricsNamespace+"_template_cache_hit_ratio", "Template cache hits over lookups since start.", nil, nil)
+	chromeBusyDesc     = prometheus.NewDesc(metricsNamespace+"_chrome_busy", "Pooled browsers currently rendering.", nil, nil)
+	chromePoolDesc     = prometheus.NewDesc(metricsNamespace+"_chrome_pool_size", "Browsers in the pool.", nil, nil)
+	rateAllowedDesc    = prometheus.NewDesc(metricsNamespace+"_rate_limit_allowed_total", "Requests allowed by the per-client rate limit.", []string{"route"}, nil)
+	rateRejectedDesc   = prometheus.NewDesc(metricsNamespace+"_rate_limit_rejected_total", "Requests rejected by the per-client rate limit.", []string{"route"}, nil)
+	rateClientsDesc    = prometheus.NewDesc(metricsNamespace+"_rate_limit_clients", "Clients with a rate limit bucket.", []string{"route"}, nil)
+	gateInFlightDesc   = prometheus.NewDesc(metricsNamespace+"_render_gate_in_flight", "Renders holding a render gate slot.", nil, nil)
+	gateQueuedDesc     = prometheus.NewDesc(metricsNamespace+"_render_gate_queued", "Renders waiting for a render gate slot.", nil, nil)
+	gateRejectedDesc   = prometheus.NewDesc(metricsNamespace+"_render_gate_rejected_total", "Renders rejected by the render gate by reason (queue_full or timeout).", []string{"reason"}, nil)
+	gateWaitDesc       = prometheus.NewDesc(metricsNamespace+"_render_gate_wait_seconds_total", "Time renders spent queued for a slot.", nil, nil)
+)
+
+func (statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		cacheEntriesDesc, cacheBytesDesc, cacheLookupsDesc, cacheEvictionsDesc, cacheHitRateDesc,
+		chromeBusyDesc, chromePoolDesc,
+		rateAllowedDesc, rateRejectedDesc, rateClientsDesc,
+		gateInFlightDesc, gateQueuedDesc, gateRejectedDesc, gateWaitDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (statsCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, labels...)
+	}
+
+	if tmplCache != nil {
+		s := tmplCache.stats()
+		gauge(cacheEntriesDesc, float64(s.Entries))
+		gauge(cacheBytesDesc, float64(s.Bytes))
+		counter(cacheLookupsDesc, float64(s.Hits), "hit")
+		counter(cacheLookupsDesc, float64(s.Misses), "miss")
+		counter(cacheEvictionsDesc, float64(s.Evictions))
+		gauge(cacheHitRateDesc, s.HitRate)
+	}
+
+	if pdfPool != nil {
+		gauge(chromePoolDesc, float64(pdfPool.cfg.PoolSize))
+		gauge(chromeBusyDesc, float64(pdfPool.cfg.PoolSize-len(pdfPool.slots)))
+	}
+
+	if limits != nil {
+		s := limits.stats()
+		for _, r := range s.Routes {
+			counter(rateAllowedDesc, float64(r.Allowed), r.Route)
+			counter(rateRejectedDesc, float64(r.Rejected), r.Route)
+			gauge(rateClientsDesc, float64(r.Clients), r.Route)
+		}
+		gauge(gateInFlightDesc, float64(s.Render.InFlight))
+		gauge(gateQueuedDesc, float64(s.Render.Queued))
+		counter(gateRejectedDesc, float64(s.Render.RejectedFull), "queue_full")
+		counter(gateRejectedDesc, float64(s.Render.RejectedTimeout), "timeout")
+		counter(gateWaitDesc, s.Render.WaitSeconds)
+	}
+}
@@ -1,6 +1,28 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+// allowedOrigins are the CORS origins in effect; they are replaced when the
+// config is reloaded
+var allowedOrigins atomic.Pointer[[]string]
+
+// setAllowedOrigins replaces the CORS origins
+func setAllowedOrigins(origins []string) {
+	allowedOrigins.Store(&origins)
+}
+
+// withBodyLimit caps the request body at server.max_body_bytes, so nothing
+// after it, authentication included, reads an unbounded body
+func withBodyLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, config.Server.MaxBodyBytes)
+		next(w, r)
+	}
+}
 
 // withCORS wraps a handler with CORS headers for allowed origins
 func withCORS(next http.HandlerFunc) http.HandlerFunc {
@@ -9,18 +31,15 @@ func withCORS(next http.HandlerFunc) http.HandlerFunc {
 
 		// Check if origin is in allowed list
 		allowed := false
-		for _, o := range config.AllowedOrigins {
-			if origin == o {
-				allowed = true
-				break
-			}
+		if origins := allowedOrigins.Load(); origins != nil {
+			allowed = slices.Contains(*origins, origin)
 		}
 
 		if allowed {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Client-ID, X-Timestamp, X-Signature, X-Request-ID")
 		}
 
 		if r.Method == http.MethodOptions {
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/cdproto/page"
+)
+
+// defaultPDFMargin is the margin used on every side when none is given, in inches
+const defaultPDFMargin = 0.4
+
+// paperSizes are the named paper sizes accepted in pdf_options, in millimetres (portrait)
+var paperSizes = map[string][2]float64{
+	"A3":      {297, 420},
+	"A4":      {210, 297},
+	"A5":      {148, 210},
+	"B5":      {176, 250},
+	"F4":      {215, 330},
+	"LETTER":  {215.9, 279.4},
+	"LEGAL":   {215.9, 355.6},
+	"TABLOID": {279.4, 431.8},
+}
+
+// lengthUnits converts a length unit to inches
+var lengthUnits = map[string]float64{
+	"in": 1,
+	"cm": 1 / 2.54,
+	"mm": 1 / 25.4,
+	"pt": 1.0 / 72,
+	"px": 1.0 / 96,
+}
+
+var (
+	lengthPattern    = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*(in|cm|mm|pt|px)?$`)
+	pageRangePattern = regexp.MustCompile(`^(\d+)?\s*(-)?\s*(\d+)?$`)
+)
+
+// PDFLength is a length in inches. In JSON it is either a number of inches or
+// a string with a unit: "0.4in", "10mm", "1cm", "12pt" or "96px".
+type PDFLength float64
+
+// UnmarshalJSON accepts a number of inches or a string with a unit
+func (l *PDFLength) UnmarshalJSON(b []byte) error {
+	var n float64
+	if err := json.Unmarshal(b, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("length must not be negative")
+		}
+		*l = PDFLength(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("length must be a number of inches or a string like \"10mm\"")
+	}
+	v, err := parsePDFLength(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// UnmarshalText accepts a length such as "10mm" in config files and environment variables
+func (l *PDFLength) UnmarshalText(b []byte) error {
+	v, err := parsePDFLength(string(b))
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// parsePDFLength parses a length such as "10mm"; a bare number is in inches
+func parsePDFLength(s string) (PDFLength, error) {
+	m := lengthPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid length %q (use a number with in, cm, mm, pt or px)", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid length %q", s)
+	}
+	unit := m[2]
+	if unit == "" {
+		unit = "in"
+	}
+	return PDFLength(n * lengthUnits[unit]), nil
+}
+
+// PDFMargins are the page margins; unset sides default to the configured margin (0.4in)
+type PDFMargins struct {
+	Top    *PDFLength `json:"top,omitempty"`
+	Right  *PDFLength `json:"right,omitempty"`
+	Bottom *PDFLength `json:"bottom,omitempty"`
+	Left   *PDFLength `json:"left,omitempty"`
+}
+
+// PDFOptions are the Chrome print settings of a PDF request. The zero value
+// prints with the configured defaults: CSS @page size, else the default paper
+// size, 0.4in margins and backgrounds on.
+type PDFOptions struct {
+	Orientation         string      `json:"orientation,omitempty"`           // portrait (default) or landscape
+	PaperSize           string      `json:"paper_size,omitempty"`            // A3, A4, A5, B5, F4, Letter, Legal or Tabloid
+	PaperWidth          *PDFLength  `json:"paper_width,omitempty"`           // custom paper width, overrides paper_size
+	PaperHeight         *PDFLength  `json:"paper_height,omitempty"`          // custom paper height, overrides paper_size
+	Margin              *PDFMargins `json:"margin,omitempty"`                // page margins
+	Scale               float64     `json:"scale,omitempty"`                 // 0.1 to 2 (default: 1)
+	PageRanges          string      `json:"page_ranges,omitempty"`           // e.g. "1-3, 5"; default all pages
+	PrintBackground     *bool       `json:"print_background,omitempty"`      // default: true
+	PreferCSSPageSize   *bool       `json:"prefer_css_page_size,omitempty"`  // default: true unless a paper size or orientation is given
+	DisplayHeaderFooter bool        `json:"display_header_footer,omitempty"` // print header_template and footer_template
+	HeaderTemplate      string      `json:"header_template,omitempty"`       // Chrome header HTML
+	FooterTemplate      string      `json:"footer_template,omitempty"`       // Chrome footer HTML
+}
+
+// printParams validates the options and returns the Chrome PrintToPDF call.
+// A nil receiver returns the defaults.
+func (o *PDFOptions) printParams() (*page.PrintToPDFParams, error) {
+	if o == nil {
+		o = &PDFOptions{}
+	}
+
+	margin := float64(config.PDF.Margin)
+	params := page.PrintToPDF().
+		WithPrintBackground(o.PrintBackground == nil || *o.PrintBackground).
+		WithMarginTop(margin).
+		WithMarginRight(margin).
+		WithMarginBottom(margin).
+		WithMarginLeft(margin)
+
+	// Paper size. The configured default only applies to templates without a
+	// CSS @page size, like Chrome's own default.
+	paperSize, orientation := o.PaperSize, o.Orientation
+	explicit := paperSize != "" || o.PaperWidth != nil || o.PaperHeight != nil || orientation != ""
+	if paperSize == "" && o.PaperWidth == nil && o.PaperHeight == nil {
+		paperSize = config.PDF.PaperSize
+	}
+	if orientation == "" {
+		orientation = config.PDF.Orientation
+	}
+	var width, height float64
+	if paperSize != "" {
+		size, ok := paperSizes[strings.ToUpper(paperSize)]
+		if !ok {
+			return nil, pdfOptionsError("unknown paper_size %q (use A3, A4, A5, B5, F4, Letter, Legal or Tabloid)", paperSize)
+		}
+		width, height = size[0]*lengthUnits["mm"], size[1]*lengthUnits["mm"]
+	}
+	if o.PaperWidth != nil {
+		width = float64(*o.PaperWidth)
+	}
+	if o.PaperHeight != nil {
+		height = float64(*o.PaperHeight)
+	}
+	if o.PaperSize == "" && (o.PaperWidth == nil) != (o.PaperHeight == nil) {
+		return nil, pdfOptionsError("paper_width and paper_height must be given together")
+	}
+	if (o.PaperWidth != nil || o.PaperHeight != nil) && (width <= 0 || height <= 0) {
+		return nil, pdfOptionsError("paper_width and paper_height must be positive")
+	}
+	if width > 0 {
+		params.PaperWidth = width
+		params.PaperHeight = height
+	}
+
+	switch strings.ToLower(orientation) {
+	case "", "portrait":
+	case "landscape":
+		params.Landscape = true
+	default:
+		return nil, pdfOptionsError("orientation must be portrait or landscape")
+	}
+
+	// An explicit paper size or orientation only takes effect when the
+	// template's CSS @page size doesn't win
+	params.PreferCSSPageSize = !explicit
+	if o.PreferCSSPageSize != nil {
+		params.PreferCSSPageSize = *o.PreferCSSPageSize
+	}
+
+	// Margins
+	if m := o.Margin; m != nil {
+		if m.Top != nil {
+			params.MarginTop = float64(*m.Top)
+		}
+		if m.Right != nil {
+			params.MarginRight = float64(*m.Right)
+		}
+		if m.Bottom != nil {
+			params.MarginBottom = float64(*m.Bottom)
+		}
+		if m.Left != nil {
+			params.MarginLeft = float64(*m.Left)
+		}
+	}
+	if params.Landscape {
+		width, height = height, width
+	}
+	if width > 0 && (params.MarginLeft+params.MarginRight >= width || params.MarginTop+params.MarginBottom >= height) {
+		return nil, pdfOptionsError("margins leave no printable area on the page")
+	}
+
+	if o.Scale != 0 {
+		if o.Scale < 0.1 || o.Scale > 2 {
+			return nil, pdfOptionsError("scale must be between 0.1 and 2")
+		}
+		params.Scale = o.Scale
+	}
+
+	if o.PageRanges != "" {
+		if err := validatePageRanges(o.PageRanges); err != nil {
+			return nil, err
+		}
+		params.PageRanges = o.PageRanges
+	}
+
+	if o.DisplayHeaderFooter {
+		params.DisplayHeaderFooter = true
+		params.HeaderTemplate = o.HeaderTemplate
+		params.FooterTemplate = o.FooterTemplate
+	} else if o.HeaderTemplate != "" || o.FooterTemplate != "" {
+		return nil, pdfOptionsError("header_template and footer_template require display_header_footer")
+	}
+
+	return params, nil
+}
+
+// validatePageRanges checks a Chrome page range list such as "1-3, 5, 8-"
+func validatePageRanges(ranges string) error {
+	for _, part := range strings.Split(ranges, ",") {
+		m := pageRangePattern.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil || (m[1] == "" && m[3] == "") || (m[2] == "" && m[3] != "") {
+			return pdfOptionsError("invalid page_ranges %q (use e.g. \"1-3, 5\")", ranges)
+		}
+		from, _ := strconv.Atoi(m[1])
+		to, _ := strconv.Atoi(m[3])
+		if m[1] != "" && from < 1 || m[3] != "" && to < 1 || m[1] != "" && m[3] != "" && from > to {
+			return pdfOptionsError("invalid page range %q in page_ranges", strings.TrimSpace(part))
+		}
+	}
+	return nil
+}
+
+// pdfOptionsError reports invalid pdf_options as a 400
+func pdfOptionsError(format string, args ...any) *renderError {
+	return newRenderError(http.StatusBadRequest, "invalid pdf_options: "+fmt.Sprintf(format, args...))
+}
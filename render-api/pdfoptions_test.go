@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// usePDFDefaults sets the configured PDF defaults for the test
+func usePDFDefaults(t *testing.T, defaults PDFDefaultsConfig) {
+	t.Helper()
+	prev := config.PDF
+	t.Cleanup(func() { config.PDF = prev })
+	config.PDF = defaults
+}
+
+// near reports whether two lengths in inches are equal to within rounding
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestParsePDFLength(t *testing.T) {
+	for in, want := range map[string]float64{
+		"1":       1,
+		"0.4":     0.4,
+		".5in":    0.5,
+		"25.4mm":  1,
+		"10mm":    10 / 25.4,
+		"2.54cm":  1,
+		"1 CM":    1 / 2.54,
+		"72pt":    1,
+		"96px":    1,
+		"48px":    0.5,
+		" 0 ":     0,
+		"0mm":     0,
+		"210mm":   210 / 25.4,
+		"8.27in ": 8.27,
+	} {
+		got, err := parsePDFLength(in)
+		if err != nil || !near(float64(got), want) {
+			t.Errorf("parsePDFLength(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "mm", "-1mm", "10 furlongs", "1e3mm", "1.2.3in", "10mm5"} {
+		if got, err := parsePDFLength(in); err == nil {
+			t.Errorf("parsePDFLength(%q) = %v, want an error", in, got)
+		}
+	}
+
+	var l PDFLength
+	if err := json.Unmarshal([]byte(`-0.5`), &l); err == nil {
+		t.Error("negative JSON length accepted")
+	}
+	if err := json.Unmarshal([]byte(`"20mm"`), &l); err != nil || !near(float64(l), 20/25.4) {
+		t.Errorf(`"20mm" = %v, %v`, l, err)
+	}
+}
+
+func TestPrintParams(t *testing.T) {
+	usePDFDefaults(t, PDFDefaultsConfig{Margin: defaultPDFMargin})
+	length := func(s string) *PDFLength {
+		l, err := parsePDFLength(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &l
+	}
+	a4w, a4h := 210/25.4, 297/25.4
+
+	tests := []struct {
+		name                  string
+		opts                  string
+		width, height         float64
+		landscape, preferCSS  bool
+		marginTop, marginLeft float64
+		wantErr               string
+	}{
+		{name: "defaults", opts: `{}`, preferCSS: true, marginTop: 0.4, marginLeft: 0.4},
+		{name: "A4", opts: `{"paper_size": "a4"}`, width: a4w, height: a4h, marginTop: 0.4, marginLeft: 0.4},
+		{name: "A4 landscape", opts: `{"paper_size": "A4", "orientation": "Landscape"}`, width: a4w, height: a4h, landscape: true, marginTop: 0.4, marginLeft: 0.4},
+		{name: "orientation only", opts: `{"orientation": "landscape"}`, landscape: true, marginTop: 0.4, marginLeft: 0.4},
+		{name: "custom size in mm", opts: `{"paper_width": "100mm", "paper_height": "15cm"}`, width: 100 / 25.4, height: 15 / 2.54, marginTop: 0.4, marginLeft: 0.4},
+		{name: "custom size in px", opts: `{"paper_width": "480px", "paper_height": 6}`, width: 5, height: 6, marginTop: 0.4, marginLeft: 0.4},
+		{name: "margins in units", opts: `{"paper_size": "A5", "margin": {"top": "1cm", "left": "36pt"}}`, width: 148 / 25.4, height: 210 / 25.4, marginTop: 1 / 2.54, marginLeft: 0.5},
+		{name: "css size kept on request", opts: `{"paper_size": "A4", "prefer_css_page_size": true}`, width: a4w, height: a4h, preferCSS: true, marginTop: 0.4, marginLeft: 0.4},
+
+		{name: "unknown paper size", opts: `{"paper_size": "A0"}`, wantErr: "unknown paper_size"},
+		{name: "width without height", opts: `{"paper_width": "100mm"}`, wantErr: "given together"},
+		{name: "zero width", opts: `{"paper_width": 0, "paper_height": 5}`, wantErr: "must be positive"},
+		{name: "bad orientation", opts: `{"orientation": "sideways"}`, wantErr: "orientation"},
+		{name: "margins wider than the page", opts: `{"paper_width": "100mm", "paper_height": "100mm", "margin": {"left": "50mm", "right": "50mm"}}`, wantErr: "no printable area"},
+		{name: "margins taller than the page", opts: `{"paper_size": "A5", "margin": {"top": "10cm", "bottom": "11cm"}}`, wantErr: "no printable area"},
+		// 160mm of top and bottom margins fit a portrait A5 (210mm) but not a landscape one (148mm)
+		{name: "margins checked against the landscape page", opts: `{"paper_size": "A5", "orientation": "landscape", "margin": {"top": "80mm", "bottom": "80mm"}}`, wantErr: "no printable area"},
+		{name: "scale too small", opts: `{"scale": 0.05}`, wantErr: "scale"},
+		{name: "scale too large", opts: `{"scale": 2.5}`, wantErr: "scale"},
+		{name: "header without display", opts: `{"header_template": "<span></span>"}`, wantErr: "display_header_footer"},
+		{name: "bad page range", opts: `{"page_ranges": "3-1"}`, wantErr: "page range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts PDFOptions
+			if err := json.Unmarshal([]byte(tt.opts), &opts); err != nil {
+				t.Fatal(err)
+			}
+			params, err := opts.printParams()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !near(params.PaperWidth, tt.width) || !near(params.PaperHeight, tt.height) {
+				t.Errorf("paper = %vx%v in, want %vx%v", params.PaperWidth, params.PaperHeight, tt.width, tt.height)
+			}
+			if params.Landscape != tt.landscape || params.PreferCSSPageSize != tt.preferCSS {
+				t.Errorf("landscape %v, prefer CSS size %v; want %v, %v", params.Landscape, params.PreferCSSPageSize, tt.landscape, tt.preferCSS)
+			}
+			if !near(params.MarginTop, tt.marginTop) || !near(params.MarginLeft, tt.marginLeft) || !near(params.MarginBottom, 0.4) {
+				t.Errorf("margins top %v left %v bottom %v", params.MarginTop, params.MarginLeft, params.MarginBottom)
+			}
+		})
+	}
+
+	// The configured defaults apply when a request gives none
+	usePDFDefaults(t, PDFDefaultsConfig{PaperSize: "Letter", Orientation: "landscape", Margin: *length("10mm")})
+	params, err := (*PDFOptions)(nil).printParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(params.PaperWidth, 8.5) || !near(params.PaperHeight, 11) || !params.Landscape || !params.PreferCSSPageSize || !near(params.MarginTop, 10/25.4) {
+		t.Errorf("configured defaults = %+v", params)
+	}
+}
+
+func TestValidatePageRanges(t *testing.T) {
+	for _, ranges := range []string{"1", "1-3", "1-3, 5", "5-", "-3", "2-2", " 1 - 3 ,4"} {
+		if err := validatePageRanges(ranges); err != nil {
+			t.Errorf("validatePageRanges(%q) = %v", ranges, err)
+		}
+	}
+	for _, ranges := range []string{"0", "0-2", "3-1", "a", "1-a", "-", "1,", ",1", "1--3", "1-3-5", "1 3"} {
+		if err := validatePageRanges(ranges); err == nil {
+			t.Errorf("validatePageRanges(%q) accepted", ranges)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// errPoolClosed is returned when a browser is requested after shutdown
+var errPoolClosed = errors.New("browser pool is closed")
+
+// pdfPool is the shared Chrome pool used by all PDF handlers
+var pdfPool *browserPool
+
+// pooledBrowser is a long-lived Chrome process with one warm tab ready for rendering
+type pooledBrowser struct {
+	id          int
+	allocCancel context.CancelFunc
+	ctx         context.Context // browser-level chromedp context
+	cancel      context.CancelFunc
+	tab         context.Context // warm tab handed out to the next render
+	tabCancel   context.CancelFunc
+	renders     int
+}
+
+// browserPool hands out a fixed number of Chrome processes to PDF renders.
+// Each slot is owned by exactly one goroutine at a time: whoever received it
+// from the slots channel may launch, restart or use it before sending it back.
+type browserPool struct {
+	cfg       BrowserConfig
+	opts      []chromedp.ExecAllocatorOption
+	slots     chan *pooledBrowser
+	done      chan struct{}
+	closeOnce sync.Once
+	ctx       context.Context // parent of every Chrome process; cancelled to kill them all
+	kill      context.CancelFunc
+}
+
+// newBrowserPool creates a pool; browsers are launched lazily or by warm
+func newBrowserPool(cfg BrowserConfig) *browserPool {
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.Flag("disable-gpu", true),
+	)
+	if cfg.ChromePath != "" {
+		opts = append(opts, chromedp.ExecPath(cfg.ChromePath))
+	}
+	opts = append(opts, chromeFlags(cfg.Flags)...)
+
+	ctx, kill := context.WithCancel(context.Background())
+	p := &browserPool{
+		cfg:   cfg,
+		opts:  opts,
+		slots: make(chan *pooledBrowser, cfg.PoolSize),
+		done:  make(chan struct{}),
+		ctx:   ctx,
+		kill:  kill,
+	}
+	for i := 0; i < cfg.PoolSize; i++ {
+		p.slots <- &pooledBrowser{id: i + 1}
+	}
+
+	go p.healthLoop()
+	return p
+}
+
+// chromeFlags turns configured flags such as "lang=id-ID", "no-sandbox" or
+// "headless=false" into allocator options
+func chromeFlags(flags []string) []chromedp.ExecAllocatorOption {
+	var opts []chromedp.ExecAllocatorOption
+	for _, f := range flags {
+		name, value, ok := strings.Cut(f, "=")
+		switch {
+		case !ok:
+			opts = append(opts, chromedp.Flag(name, true))
+		case value == "true" || value == "false":
+			opts = append(opts, chromedp.Flag(name, value == "true"))
+		default:
+			opts = append(opts, chromedp.Flag(name, value))
+		}
+	}
+	return opts
+}
+
+// warm launches every browser in the pool so the first renders don't pay startup cost
+func (p *browserPool) warm() {
+	for i := 0; i < p.cfg.PoolSize; i++ {
+		b, err := p.acquire(context.Background())
+		if err != nil {
+			slog.Error("chrome pool: warm-up failed", "error", err)
+			return
+		}
+		defer func() { p.slots <- b }()
+	}
+	slog.Info("chrome pool: browsers ready", "count", p.cfg.PoolSize)
+}
+
+// acquire waits for an idle browser with a warm tab
+func (p *browserPool) acquire(ctx context.Context) (*pooledBrowser, error) {
+	select {
+	case <-p.done:
+		return nil, errPoolClosed
+	default:
+	}
+
+	select {
+	case b := <-p.slots:
+		if err := p.ensure(b); err != nil {
+			p.slots <- b
+			return nil, err
+		}
+		return b, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for browser: %w", ctx.Err())
+	case <-p.done:
+		return nil, errPoolClosed
+	}
+}
+
+// release returns a browser to the pool after a render. The used tab is closed
+// and the browser is recycled in the background so the caller isn't delayed.
+func (p *browserPool) release(b *pooledBrowser, renderErr error) {
+	b.renders++
+	go func() {
+		p.recycle(b, renderErr)
+		p.slots <- b
+	}()
+}
+
+// recycle prepares a browser for its next render, restarting it if it crashed
+// or has reached its render budget
+func (p *browserPool) recycle(b *pooledBrowser, renderErr error) {
+	b.closeTab()
+
+	select {
+	case <-p.done:
+		b.stop()
+		return
+	default:
+	}
+
+	switch {
+	case renderErr != nil && !b.alive():
+		slog.Warn("chrome pool: browser crashed, restarting", "browser", b.id, "error", renderErr)
+		chromeRestarts.WithLabelValues("crash").Inc()
+		p.restart(b)
+	case p.cfg.MaxRenders > 0 && b.renders >= p.cfg.MaxRenders:
+		slog.Info("chrome pool: browser reached its render budget, recycling", "browser", b.id, "renders", b.renders)
+		chromeRestarts.WithLabelValues("max_renders").Inc()
+		p.restart(b)
+	default:
+		if err := b.openTab(); err != nil {
+			slog.Warn("chrome pool: browser failed to open tab, restarting", "browser", b.id, "error", err)
+			chromeRestarts.WithLabelValues("tab").Inc()
+			p.restart(b)
+		}
+	}
+}
+
+// ensure makes sure the browser is running and has a warm tab
+func (p *browserPool) ensure(b *pooledBrowser) error {
+	if b.ctx == nil || b.ctx.Err() != nil {
+		return p.launch(b)
+	}
+	if b.tab == nil {
+		if err := b.openTab(); err != nil {
+			return p.launch(b)
+		}
+	}
+	return nil
+}
+
+// launch starts a fresh Chrome process for the slot
+func (p *browserPool) launch(b *pooledBrowser) error {
+	b.stop()
+
+	allocCtx, allocCancel := chromedp.NewExecAllocator(p.ctx, p.opts...)
+	ctx, cancel := chromedp.NewContext(allocCtx, chromedp.WithErrorf(func(format string, args ...any) {
+		slog.Error("chromedp error", "browser", b.id, "error", fmt.Sprintf(format, args...))
+	}))
+	if err := chromedp.Run(ctx); err != nil {
+		cancel()
+		allocCancel()
+		return fmt.Errorf("failed to start chrome: %w", err)
+	}
+
+	chromeProcesses.Inc()
+	b.allocCancel = allocCancel
+	b.ctx = ctx
+	b.cancel = cancel
+	b.renders = 0
+
+	if err := b.openTab(); err != nil {
+		b.stop()
+		return err
+	}
+	return nil
+}
+
+// restart relaunches the browser, leaving the slot empty on failure so the
+// next acquire retries
+func (p *browserPool) restart(b *pooledBrowser) {
+	if err := p.launch(b); err != nil {
+		slog.Error("chrome pool: browser restart failed", "browser", b.id, "error", err)
+	}
+}
+
+// healthLoop periodically pings idle browsers and restarts dead ones
+func (p *browserPool) healthLoop() {
+	ticker := time.NewTicker(p.cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		var idle []*pooledBrowser
+	collect:
+		for i := 0; i < p.cfg.PoolSize; i++ {
+			select {
+			case b := <-p.slots:
+				idle = append(idle, b)
+			default:
+				break collect
+			}
+		}
+
+		for _, b := range idle {
+			if b.ctx != nil && !b.alive() {
+				slog.Warn("chrome pool: browser failed health check, restarting", "browser", b.id)
+				chromeRestarts.WithLabelValues("health_check").Inc()
+				p.restart(b)
+			}
+			p.slots <- b
+		}
+	}
+}
+
+// Close stops accepting renders, waits for in-flight renders to finish and
+// stops every browser, removing its profile directory. When ctx is done first,
+// browsers still rendering are killed and their renders fail.
+func (p *browserPool) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.done) })
+
+	stopped := 0
+	drain := func(ctx context.Context) error {
+		for ; stopped < p.cfg.PoolSize; stopped++ {
+			select {
+			case b := <-p.slots:
+				b.stop()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	if err := drain(ctx); err == nil {
+		return nil
+	}
+
+	slog.Warn("chrome pool: renders still running at shutdown, killing browsers", "busy", p.cfg.PoolSize-stopped)
+	p.kill()
+	// The failed renders hand their browsers back at once; wait briefly so
+	// their profile directories are removed before the process exits
+	killCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := drain(killCtx); err != nil {
+		return fmt.Errorf("closing browser pool: %w", err)
+	}
+	return nil
+}
+
+// openTab creates a new warm tab in the browser
+func (b *pooledBrowser) openTab() error {
+	tab, tabCancel := chromedp.NewContext(b.ctx)
+	if err := chromedp.Run(tab); err != nil {
+		tabCancel()
+		return fmt.Errorf("failed to open tab: %w", err)
+	}
+	b.tab = tab
+	b.tabCancel = tabCancel
+	return nil
+}
+
+// closeTab closes the tab used by the previous render
+func (b *pooledBrowser) closeTab() {
+	if b.tabCancel != nil {
+		b.tabCancel()
+	}
+	b.tab = nil
+	b.tabCancel = nil
+}
+
+// alive reports whether the browser still answers CDP commands
+func (b *pooledBrowser) alive() bool {
+	if b.ctx == nil || b.ctx.Err() != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+
+	var n int
+	return chromedp.Run(ctx, chromedp.Evaluate(`1`, &n)) == nil
+}
+
+// stop kills the Chrome process and clears the slot
+func (b *pooledBrowser) stop() {
+	if b.ctx != nil {
+		chromeProcesses.Dec()
+	}
+	b.closeTab()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if b.allocCancel != nil {
+		b.allocCancel()
+	}
+	b.ctx = nil
+	b.cancel = nil
+	b.allocCancel = nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limits is the shared per-client rate limiter and render gate
+var limits *limiter
+
+// idleBucketTTL is how long an unused client bucket is kept before it is
+// dropped; a dropped bucket starts full again
+const idleBucketTTL = 10 * time.Minute
+
+// RouteLimit is a token bucket limit applied to each client of a route
+type RouteLimit struct {
+	Rate  float64 `yaml:"rate"`  // requests per second refilled; 0 disables the limit
+	Burst int     `yaml:"burst"` // bucket size, the most requests allowed at once
+}
+
+// LimiterStats reports rate limiter and render gate usage
+type LimiterStats struct {
+	PerIP  RouteLimitStats   `json:"per_ip"`
+	Routes []RouteLimitStats `json:"routes"`
+	Render RenderGateStats   `json:"render"`
+}
+
+// RouteLimitStats reports the token bucket usage of one route
+type RouteLimitStats struct {
+	Route    string  `json:"route"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	Clients  int     `json:"clients"`
+	Allowed  uint64  `json:"allowed"`
+	Rejected uint64  `json:"rejected"`
+}
+
+// RenderGateStats reports concurrent render usage
+type RenderGateStats struct {
+	MaxConcurrent   int     `json:"max_concurrent"`
+	MaxQueue        int     `json:"max_queue"`
+	InFlight        int     `json:"in_flight"`
+	Queued          int     `json:"queued"`
+	Admitted        uint64  `json:"admitted"`
+	RejectedFull    uint64  `json:"rejected_queue_full"`
+	RejectedTimeout uint64  `json:"rejected_timeout"`
+	WaitSeconds     float64 `json:"wait_seconds_total"`
+}
+
+// tokenBucket holds one client's tokens for a route
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// routeLimiter keeps a token bucket per client for one route
+type routeLimiter struct {
+	route string
+	limit RouteLimit
+
+	mu                sync.Mutex
+	buckets           map[string]*tokenBucket
+	allowed, rejected uint64
+}
+
+// allow takes a token from the client's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *routeLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		l.rejected++
+		return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	l.allowed++
+	return true, 0
+}
+
+// current returns the route's limit
+func (l *routeLimiter) current() RouteLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// stats returns a snapshot of the route's usage
+func (l *routeLimiter) stats() RouteLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RouteLimitStats{
+		Route:    l.route,
+		Rate:     l.limit.Rate,
+		Burst:    l.limit.Burst,
+		Clients:  len(l.buckets),
+		Allowed:  l.allowed,
+		Rejected: l.rejected,
+	}
+}
+
+// sweep drops buckets that haven't been used since before cutoff
+func (l *routeLimiter) sweep(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// errRenderBusy is returned when the render gate's wait queue is full or a
+// queued render waited too long
+var errRenderBusy = errors.New("too many renders in progress")
+
+// renderWaitKey marks a context whose renders were already admitted
+type renderWaitKey struct{}
+
+// withRenderWait returns a context whose renders wait for a gate slot for as
+// long as ctx lives instead of being rejected. Batch items and jobs use it:
+// their request was admitted once and they are bounded by their own
+// concurrency.
+func withRenderWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, renderWaitKey{}, true)
+}
+
+// renderGate bounds the Chrome renders running at once across synchronous
+// requests, batch items and jobs. Renders beyond the limit wait in a bounded
+// queue; when the queue is full they are rejected at once.
+type renderGate struct {
+	slots    chan struct{}
+	maxQueue int
+	timeout  time.Duration
+
+	mu                                      sync.Mutex
+	queued                                  int
+	admitted, rejectedFull, rejectedTimeout uint64
+	waited                                  time.Duration
+	avgHold                                 time.Duration // moving average of how long a slot is held
+}
+
+// acquire waits for a render slot. It returns errRenderBusy when the queue is
+// full or no slot frees up within the gate's timeout, unless ctx comes from
+// withRenderWait.
+func (g *renderGate) acquire(ctx context.Context) error {
+	select {
+	case g.slots <- struct{}{}:
+		g.mu.Lock()
+		g.admitted++
+		g.mu.Unlock()
+		return nil
+	default:
+	}
+
+	admitted, _ := ctx.Value(renderWaitKey{}).(bool)
+	g.mu.Lock()
+	if !admitted && g.queued >= g.maxQueue {
+		g.rejectedFull++
+		g.mu.Unlock()
+		return errRenderBusy
+	}
+	g.queued++
+	timeout := g.timeout
+	g.mu.Unlock()
+
+	start := time.Now()
+	var expired <-chan time.Time
+	if !admitted {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case g.slots <- struct{}{}:
+	case <-expired:
+		err = errRenderBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.queued--
+	g.waited += time.Since(start)
+	switch {
+	case err == nil:
+		g.admitted++
+	case errors.Is(err, errRenderBusy):
+		g.rejectedTimeout++
+	}
+	return err
+}
+
+// full reports whether every slot is held and the queue is full, so a new
+// render would be rejected. Rejections counted here are reported as queue_full.
+func (g *renderGate) full() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.slots) < cap(g.slots) || g.queued < g.maxQueue {
+		return false
+	}
+	g.rejectedFull++
+	return true
+}
+
+// release frees a slot that was held for d
+func (g *renderGate) release(d time.Duration) {
+	<-g.slots
+	g.mu.Lock()
+	if g.avgHold == 0 {
+		g.avgHold = d
+	} else {
+		g.avgHold = (g.avgHold*7 + d) / 8
+	}
+	g.mu.Unlock()
+}
+
+// retryAfter estimates how long until the queue has drained enough for a new
+// request to be admitted
+func (g *renderGate) retryAfter() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	hold := g.avgHold
+	if hold == 0 {
+		hold = time.Second
+	}
+	return hold * time.Duration(g.queued+1) / time.Duration(cap(g.slots))
+}
+
+// stats returns a snapshot of gate usage
+func (g *renderGate) stats() RenderGateStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return RenderGateStats{
+		MaxConcurrent:   cap(g.slots),
+		MaxQueue:        g.maxQueue,
+		InFlight:        len(g.slots),
+		Queued:          g.queued,
+		Admitted:        g.admitted,
+		RejectedFull:    g.rejectedFull,
+		RejectedTimeout: g.rejectedTimeout,
+		WaitSeconds:     g.waited.Seconds(),
+	}
+}
+
+// limiter holds the per-IP limit, the per-route client limits and the shared
+// render gate
+type limiter struct {
+	cfg    RateLimitConfig
+	mu     sync.Mutex
+	ip     *routeLimiter
+	routes map[string]*routeLimiter
+	render *renderGate
+}
+
+// newLimiter creates the limiter and starts sweeping idle client buckets
+func newLimiter(cfg RateLimitConfig) *limiter {
+	l := &limiter{
+		cfg:    cfg,
+		ip:     &routeLimiter{route: "per-ip", limit: cfg.PerIP, buckets: make(map[string]*tokenBucket)},
+		routes: make(map[string]*routeLimiter),
+		render: &renderGate{
+			slots:    make(chan struct{}, cfg.MaxConcurrent),
+			maxQueue: cfg.MaxQueue,
+			timeout:  cfg.QueueTimeout,
+		},
+	}
+	go l.sweepLoop()
+	return l
+}
+
+// route returns the limiter for a route, or nil if the route is unlimited
+func (l *limiter) route(route string) *routeLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rl, ok := l.routes[route]; ok {
+		if rl.current().Rate <= 0 {
+			return nil
+		}
+		return rl
+	}
+	limit, ok := l.cfg.Routes[route]
+	if !ok {
+		limit = l.cfg.Default
+	}
+	if limit.Rate <= 0 {
+		return nil
+	}
+	rl := &routeLimiter{route: route, limit: limit, buckets: make(map[string]*tokenBucket)}
+	l.routes[route] = rl
+	return rl
+}
+
+// update applies reloaded rate limits and render queue limits. Only the rate
+// and burst of existing routes change: clients keep their buckets and the
+// tokens left in them, and a route whose limit is turned off keeps its buckets
+// for when it is turned back on. The number of concurrent renders only
+// changes on restart.
+func (l *limiter) update(cfg RateLimitConfig) {
+	l.mu.Lock()
+	l.cfg.Default = cfg.Default
+	l.cfg.Routes = cfg.Routes
+	l.cfg.PerIP = cfg.PerIP
+	l.ip.mu.Lock()
+	l.ip.limit = cfg.PerIP
+	l.ip.mu.Unlock()
+	for route, rl := range l.routes {
+		limit, ok := cfg.Routes[route]
+		if !ok {
+			limit = cfg.Default
+		}
+		rl.mu.Lock()
+		rl.limit = limit
+		rl.mu.Unlock()
+	}
+	l.mu.Unlock()
+
+	l.render.mu.Lock()
+	l.render.maxQueue = cfg.MaxQueue
+	l.render.timeout = cfg.QueueTimeout
+	l.render.mu.Unlock()
+}
+
+func (l *limiter) sweepLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-idleBucketTTL)
+		l.ip.sweep(cutoff)
+		l.mu.Lock()
+		for _, rl := range l.routes {
+			rl.sweep(cutoff)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// stats returns a snapshot of limiter usage
+func (l *limiter) stats() LimiterStats {
+	l.mu.Lock()
+	s := LimiterStats{PerIP: l.ip.stats(), Routes: make([]RouteLimitStats, 0, len(l.routes))}
+	for _, rl := range l.routes {
+		s.Routes = append(s.Routes, rl.stats())
+	}
+	l.mu.Unlock()
+
+	sort.Slice(s.Routes, func(i, j int) bool { return s.Routes[i].Route < s.Routes[j].Route })
+	s.Render = l.render.stats()
+	return s
+}
+
+// clientKey identifies the caller of a request for rate limiting: the
+// authenticated client when there is one, else the remote IP
+func clientKey(r *http.Request) string {
+	if c := clientFromContext(r.Context()); c != nil {
+		return "client:" + c.ID
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// remoteIP returns the address of the peer that sent r
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeTooManyRequests writes a 429 with a Retry-After of at least one second
+func writeTooManyRequests(w http.ResponseWriter, retry time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+	writeJSON(w, http.StatusTooManyRequests, RenderResponse{Error: msg})
+}
+
+// withRateLimit wraps a handler with the route's per-client token bucket.
+// Routes without a configured rate are passed straight through.
+func withRateLimit(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rl := limits.route(route)
+		if rl == nil || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		client := clientKey(r)
+		if ok, retry := rl.allow(client, time.Now()); !ok {
+			limit := rl.current()
+			slog.WarnContext(r.Context(), "rate limit exceeded",
+				"client", client, "route", route, "rate", limit.Rate, "burst", limit.Burst)
+			writeTooManyRequests(w, retry, fmt.Sprintf("rate limit exceeded for %s", route))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withIPRateLimit wraps a handler with the per-IP token bucket shared by
+// every route. It runs before authentication, so callers with bad or no
+// credentials are throttled too.
+func withIPRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limits.ip.current().Rate <= 0 || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		ip := remoteIP(r)
+		if ok, retry := limits.ip.allow(ip, time.Now()); !ok {
+			limit := limits.ip.current()
+			slog.WarnContext(r.Context(), "per-IP rate limit exceeded",
+				"remote", ip, "path", r.URL.Path, "rate", limit.Rate, "burst", limit.Burst)
+			writeTooManyRequests(w, retry, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withRenderSlot wraps a handler that drives Chrome so it is rejected before
+// reading its body when the render gate is already full. The slot itself is
+// taken around each Chrome render by generatePDF.
+func withRenderSlot(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && limits.render.full() {
+			slog.WarnContext(r.Context(), "render gate: rejected request",
+				"method", r.Method, "path", r.URL.Path, "client", clientKey(r), "error", errRenderBusy)
+			writeTooManyRequests(w, limits.render.retryAfter(), errRenderBusy.Error())
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenderGate(t *testing.T) {
+	g := &renderGate{slots: make(chan struct{}, 1), maxQueue: 1, timeout: 20 * time.Millisecond}
+	ctx := context.Background()
+
+	if err := g.acquire(ctx); err != nil {
+		t.Fatalf("first render: %v", err)
+	}
+	if g.full() {
+		t.Fatal("gate is full with an empty queue")
+	}
+
+	// A queued render times out while the slot is held
+	if err := g.acquire(ctx); !errors.Is(err, errRenderBusy) {
+		t.Fatalf("queued render: got %v, want errRenderBusy", err)
+	}
+
+	// An admitted render waits past the timeout and fills the queue
+	admitted := make(chan error, 1)
+	go func() { admitted <- g.acquire(withRenderWait(ctx)) }()
+	for g.stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !g.full() {
+		t.Error("gate isn't full with every slot held and the queue full")
+	}
+	if err := g.acquire(ctx); !errors.Is(err, errRenderBusy) {
+		t.Errorf("render over a full queue: got %v, want errRenderBusy", err)
+	}
+
+	time.Sleep(2 * g.timeout)
+	g.release(time.Millisecond)
+	if err := <-admitted; err != nil {
+		t.Fatalf("admitted render: %v", err)
+	}
+	g.release(time.Millisecond)
+
+	s := g.stats()
+	if s.Admitted != 2 || s.RejectedTimeout != 1 || s.RejectedFull != 2 || s.InFlight != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestLimiterUpdateKeepsBuckets(t *testing.T) {
+	l := &limiter{
+		cfg:    RateLimitConfig{Default: RouteLimit{Rate: 1, Burst: 2}},
+		ip:     &routeLimiter{buckets: make(map[string]*tokenBucket)},
+		routes: make(map[string]*routeLimiter),
+		render: &renderGate{slots: make(chan struct{}, 1)},
+	}
+	now := time.Now()
+	rl := l.route("/render/pdf")
+	for range 2 {
+		if ok, _ := rl.allow("client:a", now); !ok {
+			t.Fatal("request within the burst was rejected")
+		}
+	}
+
+	// A lower rate applies to the drained bucket rather than a fresh one
+	l.update(RateLimitConfig{Default: RouteLimit{Rate: 0.5, Burst: 5}})
+	if got := l.route("/render/pdf"); got != rl {
+		t.Fatal("update replaced the route limiter")
+	}
+	if ok, retry := rl.allow("client:a", now); ok || retry != 2*time.Second {
+		t.Errorf("drained bucket after update: allowed %v, retry %v; want rejected with 2s", ok, retry)
+	}
+	if s := l.stats().Routes[0]; s.Burst != 5 || s.Rejected != 1 {
+		t.Errorf("route stats = %+v", s)
+	}
+
+	// Turning the limit off and on again keeps the bucket too
+	l.update(RateLimitConfig{})
+	if l.route("/render/pdf") != nil {
+		t.Fatal("route still limited after its rate was set to 0")
+	}
+	l.update(RateLimitConfig{Default: RouteLimit{Rate: 0.5, Burst: 5}})
+	if ok, _ := l.route("/render/pdf").allow("client:a", now); ok {
+		t.Error("re-enabled route started the drained client with a full bucket")
+	}
+}
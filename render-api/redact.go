@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// redactionProfiles are the redaction profiles in effect; they are replaced
+// when the config is reloaded
+var redactionProfiles atomic.Pointer[map[string]*RedactionProfile]
+
+// setRedactionProfiles replaces the redaction profiles
+func setRedactionProfiles(profiles map[string]*RedactionProfile) {
+	redactionProfiles.Store(&profiles)
+}
+
+// RedactionProfile maps JSON paths in a render payload to the mask applied to
+// them, e.g. {"company.pic.id_number": "nik", "owners[*].nik": "nik"}
+type RedactionProfile struct {
+	Fields map[string]string `json:"fields"`
+
+	rules []redactionRule
+}
+
+// redactionRule is a compiled path and mask from a profile
+type redactionRule struct {
+	path  string
+	segs  []pathSegment
+	apply func(string) string
+}
+
+// pathSegment is one step of a redaction path: a map key, "*" for every key,
+// an array index, or every array element ([*])
+type pathSegment struct {
+	key   string
+	index int // -1 for every element; only used when isIdx is set
+	isIdx bool
+}
+
+// maskers are the masks a redaction profile can apply to a field
+var maskers = map[string]func(string) string{
+	"nik":    maskNIKString,
+	"npwp":   maskNPWPString,
+	"phone":  maskPhoneString,
+	"email":  maskEmailString,
+	"name":   maskNameString,
+	"full":   maskAll,
+	"remove": func(string) string { return "" },
+}
+
+// compile parses the profile's paths and validates its masks
+func (p *RedactionProfile) compile() error {
+	paths := make([]string, 0, len(p.Fields))
+	for path := range p.Fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	p.rules = nil
+	for _, path := range paths {
+		mask := p.Fields[path]
+		apply, ok := maskers[mask]
+		if !ok {
+			return fmt.Errorf("unknown mask %q for %s", mask, path)
+		}
+		segs, err := parseRedactionPath(path)
+		if err != nil {
+			return err
+		}
+		p.rules = append(p.rules, redactionRule{path: path, segs: segs, apply: apply})
+	}
+	return nil
+}
+
+// parseRedactionPath parses paths like "company.pic.id_number" or "owners[*].nik"
+func parseRedactionPath(path string) ([]pathSegment, error) {
+	var segs []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		key, rest, indexed := strings.Cut(part, "[")
+		if key == "" {
+			return nil, fmt.Errorf("invalid redaction path %q: empty key", path)
+		}
+		segs = append(segs, pathSegment{key: key})
+		for indexed {
+			idx, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("invalid redaction path %q: unclosed [", path)
+			}
+			seg := pathSegment{isIdx: true, index: -1}
+			if idx != "*" {
+				n, err := strconv.Atoi(idx)
+				if err != nil || n < 0 || strings.HasPrefix(idx, "+") {
+					return nil, fmt.Errorf("invalid redaction path %q: bad index %q", path, idx)
+				}
+				seg.index = n
+			}
+			segs = append(segs, seg)
+			if after != "" && !strings.HasPrefix(after, "[") {
+				return nil, fmt.Errorf("invalid redaction path %q: unexpected %q after ]", path, after)
+			}
+			rest, indexed = strings.CutPrefix(after, "[")
+		}
+	}
+	return segs, nil
+}
+
+// redact masks the profile's fields in data in place and returns the paths
+// that matched at least one value, for the audit log
+func (p *RedactionProfile) redact(data map[string]interface{}) (masked []string, count int) {
+	for _, rule := range p.rules {
+		n := redactAt(data, rule.segs, rule.apply)
+		if n > 0 {
+			masked = append(masked, rule.path)
+			count += n
+		}
+	}
+	return masked, count
+}
+
+// redactAt walks segs from v and masks the values found at the end of the path
+func redactAt(v interface{}, segs []pathSegment, apply func(string) string) int {
+	if len(segs) == 0 {
+		return 0
+	}
+	seg, rest := segs[0], segs[1:]
+	count := 0
+
+	visit := func(child interface{}, set func(interface{})) {
+		if len(rest) > 0 {
+			count += redactAt(child, rest, apply)
+			return
+		}
+		switch val := child.(type) {
+		case string:
+			set(apply(val))
+			count++
+		case float64:
+			set(apply(strconv.FormatFloat(val, 'f', -1, 64)))
+			count++
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if seg.isIdx {
+			return 0
+		}
+		for k, child := range val {
+			if seg.key == "*" || seg.key == k {
+				visit(child, func(nv interface{}) { val[k] = nv })
+			}
+		}
+	case []interface{}:
+		if !seg.isIdx {
+			return 0
+		}
+		for i, child := range val {
+			if seg.index < 0 || seg.index == i {
+				visit(child, func(nv interface{}) { val[i] = nv })
+			}
+		}
+	}
+	return count
+}
+
+// maskMiddle replaces letters and digits with '*' except for the first keepStart
+// and last keepEnd of them, leaving separators such as dots and dashes intact
+func maskMiddle(s string, keepStart, keepEnd int) string {
+	runes := []rune(s)
+	total := 0
+	for _, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			total++
+		}
+	}
+	if total <= keepStart+keepEnd {
+		keepStart, keepEnd = 0, 0
+		if total > 2 {
+			keepEnd = 1
+		}
+	}
+
+	seen := 0
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+		if seen >= keepStart && seen < total-keepEnd {
+			runes[i] = '*'
+		}
+		seen++
+	}
+	return string(runes)
+}
+
+// maskAll replaces every character with '*'
+func maskAll(s string) string {
+	return strings.Repeat("*", len([]rune(s)))
+}
+
+// maskNIKString keeps the region code and last four digits of a NIK: 317401******0001
+func maskNIKString(s string) string {
+	return maskMiddle(s, 6, 4)
+}
+
+// maskNPWPString keeps the first two and last three digits of an NPWP
+func maskNPWPString(s string) string {
+	return maskMiddle(s, 2, 3)
+}
+
+// maskPhoneString keeps the prefix and last three digits: 6281*****123
+func maskPhoneString(s string) string {
+	return maskMiddle(s, 4, 3)
+}
+
+// maskEmailString keeps the first character of the local part and the domain: j*******@example.com
+func maskEmailString(s string) string {
+	local, domain, ok := strings.Cut(s, "@")
+	if !ok {
+		return maskMiddle(s, 1, 0)
+	}
+	if local == "" {
+		return s
+	}
+	r := []rune(local)
+	return string(r[0]) + strings.Repeat("*", len(r)-1) + "@" + domain
+}
+
+// maskNameString keeps the first letter of each word: J*** D**
+func maskNameString(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r := []rune(w)
+		words[i] = string(r[0]) + strings.Repeat("*", len(r)-1)
+	}
+	return strings.Join(words, " ")
+}
+
+// maskFunc adapts a string mask to a template function that tolerates missing values
+func maskFunc(mask func(string) string) func(interface{}) string {
+	return func(v interface{}) string {
+		if isBlank(v) {
+			return ""
+		}
+		return mask(fmt.Sprint(v))
+	}
+}
+
+// copyJSONMap deep-copies a decoded JSON object so it can be redacted without
+// touching the caller's payload
+func copyJSONMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = copyJSONValue(v)
+	}
+	return result
+}
+
+func copyJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return copyJSONMap(val)
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, item := range val {
+			result[i] = copyJSONValue(item)
+		}
+		return result
+	default:
+		return val
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRedactionPath(t *testing.T) {
+	key := func(k string) pathSegment { return pathSegment{key: k} }
+	idx := func(i int) pathSegment { return pathSegment{isIdx: true, index: i} }
+	for path, want := range map[string][]pathSegment{
+		"company.pic.id_number": {key("company"), key("pic"), key("id_number")},
+		"owners[*].nik":         {key("owners"), idx(-1), key("nik")},
+		"owners[2].nik":         {key("owners"), idx(2), key("nik")},
+		"a[0][1]":               {key("a"), idx(0), idx(1)},
+		"a[*][*].b":             {key("a"), idx(-1), idx(-1), key("b")},
+		"*.email":               {key("*"), key("email")},
+		"*":                     {key("*")},
+	} {
+		got, err := parseRedactionPath(path)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseRedactionPath(%q) = %+v, %v; want %+v", path, got, err, want)
+		}
+	}
+
+	for _, path := range []string{"", "a[", "a[0", "a[-1]", "a[+1]", "a[]", "a[x]", "a[0]b", "a[0].", "a..b", ".a", "a.", "[0]", "a.[0]"} {
+		if segs, err := parseRedactionPath(path); err == nil {
+			t.Errorf("parseRedactionPath(%q) = %+v, want an error", path, segs)
+		}
+	}
+}
+
+// redactionPayload is a decoded render payload with nested PII
+func redactionPayload() map[string]interface{} {
+	return map[string]interface{}{
+		"company": map[string]interface{}{
+			"email": "finance@example.com",
+			"pic":   map[string]interface{}{"id_number": "3174012345670001", "email": "budi@example.com"},
+		},
+		"owners": []interface{}{
+			map[string]interface{}{"nik": "3174012345670002", "email": "siti@example.com"},
+			map[string]interface{}{"nik": float64(3174012345670003)},
+		},
+		"matrix": []interface{}{
+			[]interface{}{"00", "01"},
+			[]interface{}{"10", "11"},
+		},
+		"email": "top@example.com",
+	}
+}
+
+func TestRedactionProfile(t *testing.T) {
+	p := &RedactionProfile{Fields: map[string]string{
+		"company.pic.id_number": "nik",
+		"owners[*].nik":         "nik",
+		"owners[0].email":       "email",
+		"*.email":               "full",
+		"matrix[1][0]":          "remove",
+		"missing.field":         "name",
+	}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := redactionPayload()
+	masked, count := p.redact(data)
+
+	want := redactionPayload()
+	company := want["company"].(map[string]interface{})
+	company["email"] = strings.Repeat("*", len("finance@example.com"))
+	company["pic"].(map[string]interface{})["id_number"] = "317401******0001"
+	owners := want["owners"].([]interface{})
+	owners[0].(map[string]interface{})["nik"] = "317401******0002"
+	owners[0].(map[string]interface{})["email"] = "s***@example.com"
+	owners[1].(map[string]interface{})["nik"] = "317401******0003"
+	want["matrix"].([]interface{})[1].([]interface{})[0] = ""
+
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("redacted payload:\n%v\nwant:\n%v", data, want)
+	}
+	// "*.email" matches one level below the root only: company.email
+	if wantPaths := []string{"*.email", "company.pic.id_number", "matrix[1][0]", "owners[*].nik", "owners[0].email"}; !reflect.DeepEqual(masked, wantPaths) || count != 6 {
+		t.Errorf("masked %v (%d values), want %v (6 values)", masked, count, wantPaths)
+	}
+
+	bad := &RedactionProfile{Fields: map[string]string{"owners[*].nik": "hash"}}
+	if err := bad.compile(); err == nil {
+		t.Error("compile accepted an unknown mask")
+	}
+}
+
+func TestPrepareRenderKeepsCallerPayload(t *testing.T) {
+	prevCache, prevPolicy := tmplCache, policy
+	t.Cleanup(func() { tmplCache, policy = prevCache, prevPolicy })
+	tmplCache = newTemplateCache(TemplateCacheConfig{MaxEntries: 10, MaxBytes: 1 << 20})
+	policy = &resourcePolicy{}
+
+	prevProfiles := redactionProfiles.Load()
+	t.Cleanup(func() { redactionProfiles.Store(prevProfiles) })
+	profile := &RedactionProfile{Fields: map[string]string{"owners[*].nik": "nik", "company.pic.id_number": "full"}}
+	if err := profile.compile(); err != nil {
+		t.Fatal(err)
+	}
+	setRedactionProfiles(map[string]*RedactionProfile{"external": profile})
+
+	data := redactionPayload()
+	prepared, err := prepareRender(context.Background(), renderInput{
+		Name:      "preview",
+		Template:  `{{range .owners}}<p>{{.nik}}</p>{{end}}`,
+		Data:      data,
+		Redaction: "external",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := prepared.execute(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.HTML, "317401******0002") || strings.Contains(out.HTML, "3174012345670002") {
+		t.Errorf("rendered HTML isn't redacted: %s", out.HTML)
+	}
+	if !reflect.DeepEqual(data, redactionPayload()) {
+		t.Errorf("caller's payload was modified: %v", data)
+	}
+
+	if _, err := prepareRender(context.Background(), renderInput{Name: "preview", Template: "x", Data: data, Redaction: "internal"}); err == nil {
+		t.Error("unknown redaction profile accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// watchConfig reloads the configuration on SIGHUP and, when a config file is
+// used, whenever the file changes. Editors often replace the file rather than
+// write to it, so it is polled instead of watched.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var poll <-chan time.Time
+	last := fileStamp(configFile)
+	if configFile != "" {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			reloadConfig("SIGHUP")
+		case <-poll:
+			stamp := fileStamp(configFile)
+			if stamp == last {
+				continue
+			}
+			last = stamp
+			reloadConfig("config file changed")
+		}
+	}
+}
+
+// fileStamp identifies a version of a file by its modification time and size
+func fileStamp(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10)
+}
+
+// reloadConfig loads the configuration again and applies the settings that
+// are safe to change while serving: CORS origins, redaction profiles, rate
+// limits, render queue limits and the log level. Every other changed setting
+// is logged as needing a restart. An invalid configuration is rejected as a
+// whole.
+func reloadConfig(reason string) {
+	cfg, errs := loadConfig()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("config reload rejected, keeping current settings", "reason", reason, "error", err)
+		}
+		return
+	}
+
+	applyReloadable(cfg)
+	slog.Info("config reloaded", "reason", reason,
+		"origins", cfg.AllowedOrigins,
+		"redaction_profiles", len(cfg.RedactionProfiles),
+		"rate_limit_rps", cfg.RateLimit.Default.Rate,
+		"rate_limit_routes", len(cfg.RateLimit.Routes),
+		"log_level", cfg.Log.Level.String())
+	for _, field := range restartRequired(cfg) {
+		slog.Warn("config change needs a restart to take effect, keeping the running value", "setting", field)
+	}
+}
+
+// applyReloadable puts the reloadable settings of cfg into effect
+func applyReloadable(cfg Config) {
+	setAllowedOrigins(cfg.AllowedOrigins)
+	setRedactionProfiles(cfg.RedactionProfiles)
+	limits.update(cfg.RateLimit)
+	logLevel.Set(cfg.Log.Level)
+}
+
+// restartRequired lists, by config file key, the settings of next that differ
+// from the running configuration and that a reload doesn't apply
+func restartRequired(next Config) []string {
+	cur := config
+	next.AllowedOrigins = cur.AllowedOrigins
+	next.Log.Level = cur.Log.Level
+	next.RateLimit.Default = cur.RateLimit.Default
+	next.RateLimit.Routes = cur.RateLimit.Routes
+	next.RateLimit.MaxQueue = cur.RateLimit.MaxQueue
+	next.RateLimit.QueueTimeout = cur.RateLimit.QueueTimeout
+	next.RedactionProfilesFile = cur.RedactionProfilesFile
+
+	var changed []string
+	diffConfig("", reflect.ValueOf(cur), reflect.ValueOf(next), &changed)
+	return changed
+}
+
+// diffConfig appends the keys of the settings that differ between two config
+// structs, descending into config sections. Fields without a yaml key, such
+// as compiled redaction profiles, are skipped.
+func diffConfig(prefix string, a, b reflect.Value, changed *[]string) {
+	for i := range a.NumField() {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct && isConfigSection(fa.Type()) {
+			diffConfig(key+".", fa, fb, changed)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*changed = append(*changed, key)
+		}
+	}
+}
+
+// isConfigSection reports whether t is a config section, a struct whose
+// fields have yaml keys, rather than a value type such as a CIDR
+func isConfigSection(t reflect.Type) bool {
+	for i := range t.NumField() {
+		if _, ok := t.Field(i).Tag.Lookup("yaml"); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// renderError is a render failure carrying the HTTP status and response body
+// to report to the caller
+type renderError struct {
+	status     int
+	resp       RenderResponse
+	retryAfter time.Duration // sent as Retry-After with a 429
+}
+
+// Error implements error
+func (e *renderError) Error() string {
+	return e.resp.Error
+}
+
+// newRenderError creates a renderError with just an error message
+func newRenderError(status int, msg string) *renderError {
+	return &renderError{status: status, resp: RenderResponse{Error: msg}}
+}
+
+// writeRenderError writes a render failure as a JSON error response
+func writeRenderError(w http.ResponseWriter, err error) {
+	var re *renderError
+	if errors.As(err, &re) {
+		if re.status == http.StatusTooManyRequests {
+			writeTooManyRequests(w, re.retryAfter, re.resp.Error)
+			return
+		}
+		writeJSON(w, re.status, re.resp)
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, RenderResponse{Error: err.Error()})
+}
+
+// renderInput is the template selection and payload shared by render requests
+type renderInput struct {
+	Name         string // template name used in error messages ("preview", "pdf")
+	Template     string
+	TemplateName string
+	Version      *TemplateVersion
+	Data         map[string]interface{}
+	Strict       bool
+	Redaction    string
+	InlineImages bool // replace remote image URLs in Data with data: URIs
+}
+
+// renderInput returns the template selection and payload of an HTML render request
+func (r *RenderRequest) renderInput() renderInput {
+	return renderInput{
+		Name:         "preview",
+		Template:     r.Template,
+		TemplateName: r.TemplateName,
+		Version:      r.Version,
+		Data:         r.Data,
+		Strict:       r.Strict,
+		Redaction:    r.Redaction,
+	}
+}
+
+// renderInput returns the template selection and payload of a PDF render request
+func (r *PDFRequest) renderInput() renderInput {
+	inline := config.Images.Inline
+	if r.InlineImages != nil {
+		inline = *r.InlineImages
+	}
+	return renderInput{
+		Name:         "pdf",
+		Template:     r.Template,
+		TemplateName: r.TemplateName,
+		Version:      r.Version,
+		Data:         r.Data,
+		Strict:       r.Strict,
+		Redaction:    r.Redaction,
+		InlineImages: inline,
+	}
+}
+
+// preparedRender is a parsed template and a validated, redacted and
+// sanitized payload, ready to execute
+type preparedRender struct {
+	tmpl       *template.Template
+	data       map[string]interface{}
+	stored     *storedTemplate
+	violations []SchemaViolation
+	redaction  string
+	resources  []ResourceError // blocked file URLs and remote images that couldn't be inlined
+}
+
+// renderedHTML is the output of executing a request's template
+type renderedHTML struct {
+	*preparedRender
+	HTML string
+}
+
+// renderedPDF is a generated PDF along with how it was rendered
+type renderedPDF struct {
+	*renderedHTML
+	PDF            []byte
+	Filename       string
+	ResourceErrors []ResourceError // page resources that failed to load
+}
+
+// prepareRender resolves the template and prepares the payload for a render.
+// The request data is left untouched.
+func prepareRender(ctx context.Context, in renderInput) (*preparedRender, error) {
+	_, span := tracer.Start(ctx, "template.parse", trace.WithAttributes(
+		attribute.String("template.name", in.TemplateName),
+		attribute.Bool("template.inline", in.Template != ""),
+	))
+	tmpl, stored, err := compileRequestTemplate(in.Name, in.Template, in.TemplateName, in.Version)
+	if stored != nil {
+		span.SetAttributes(attribute.String("template.file", stored.Filename))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	data := in.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	violations, err := validateRequestData(ctx, stored, data, in.Strict)
+	if err != nil {
+		return nil, err
+	}
+	if in.Redaction != "" {
+		data = copyJSONMap(data)
+		if err := redactRequestData(ctx, in.Redaction, data); err != nil {
+			return nil, err
+		}
+	}
+
+	resources := policy.fileURLErrors(data)
+	if in.InlineImages {
+		var imageErrs []ResourceError
+		data, imageErrs = images.inline(ctx, data)
+		resources = append(resources, imageErrs...)
+	}
+
+	return &preparedRender{
+		tmpl: tmpl,
+		// Auto-convert URL-like strings to safe URLs (for base64 images, etc.)
+		data:       sanitizeDataForTemplate(data),
+		stored:     stored,
+		violations: violations,
+		redaction:  in.Redaction,
+		resources:  resources,
+	}, nil
+}
+
+// execute runs the template against the prepared payload
+func (p *preparedRender) execute(ctx context.Context) (out *renderedHTML, err error) {
+	defer observeDuration(templateDuration.WithLabelValues("execute"), time.Now())
+	_, span := tracer.Start(ctx, "template.execute")
+	defer func() { endSpan(span, err) }()
+
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, p.data); err != nil {
+		return nil, newRenderError(http.StatusBadRequest, "template execute error: "+err.Error())
+	}
+	span.SetAttributes(attribute.Int("html.bytes", buf.Len()))
+	return &renderedHTML{preparedRender: p, HTML: buf.String()}, nil
+}
+
+// response returns the render metadata as a RenderResponse
+func (p *preparedRender) response() RenderResponse {
+	resp := RenderResponse{Violations: p.violations, Redaction: p.redaction}
+	if p.stored != nil {
+		resp.TemplateName = p.stored.Name
+		resp.TemplateVersion = p.stored.Version
+		resp.TemplateFile = p.stored.Filename
+	}
+	return resp
+}
+
+// renderHTML prepares and executes a render
+func renderHTML(ctx context.Context, in renderInput) (*renderedHTML, error) {
+	p, err := prepareRender(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return p.execute(ctx)
+}
+
+// renderPDF renders a PDF request's template and prints it with headless Chrome
+func renderPDF(ctx context.Context, req *PDFRequest) (*renderedPDF, error) {
+	params, err := req.PDFOptions.printParams()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := renderHTML(ctx, req.renderInput())
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := tracer.Start(ctx, "template.header_footer")
+	err = applyHeaderFooter(req, out, params)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	pdfBytes, failed, err := generatePDF(ctx, out.HTML, req.pageWait(), params)
+	if errors.Is(err, errRenderBusy) {
+		slog.WarnContext(ctx, "render gate: rejected render", "error", err)
+		return nil, &renderError{
+			status:     http.StatusTooManyRequests,
+			resp:       RenderResponse{Error: err.Error()},
+			retryAfter: limits.render.retryAfter(),
+		}
+	}
+	if err != nil {
+		pdfRenders.WithLabelValues("error").Inc()
+		slog.ErrorContext(ctx, "pdf generation failed", "error", err)
+		return nil, newRenderError(http.StatusInternalServerError, "pdf generation error: "+err.Error())
+	}
+	pdfRenders.WithLabelValues("ok").Inc()
+	pdfSize.Observe(float64(len(pdfBytes)))
+
+	// Set filename for download
+	filename := "document.pdf"
+	if req.Filename != "" {
+		filename = sanitizeName(req.Filename) + ".pdf"
+	}
+
+	if out.stored != nil {
+		slog.InfoContext(ctx, "rendered pdf", "template", out.stored.Filename, "version", out.stored.Version, "bytes", len(pdfBytes))
+	}
+	failed = append(out.resources, failed...)
+	for _, f := range failed {
+		slog.WarnContext(ctx, "pdf resource failed to load", "url", f.URL, "error", f.Error)
+	}
+	return &renderedPDF{renderedHTML: out, PDF: pdfBytes, Filename: filename, ResourceErrors: failed}, nil
+}
+
+// compileRequestTemplate returns the parsed template for a render, either sent
+// inline or resolved from the templates directory by name and version.
+// Parsed templates are served from tmplCache.
+func compileRequestTemplate(tmplName, source, name string, version *TemplateVersion) (*template.Template, *storedTemplate, error) {
+	if source != "" && name != "" {
+		return nil, nil, newRenderError(http.StatusBadRequest, "template and template_name are mutually exclusive")
+	}
+
+	if name == "" {
+		if source == "" {
+			return nil, nil, newRenderError(http.StatusBadRequest, "template or template_name is required")
+		}
+		tmpl, err := tmplCache.inline(tmplName, source)
+		if err != nil {
+			return nil, nil, newRenderError(http.StatusBadRequest, "template parse error: "+err.Error())
+		}
+		return tmpl, nil, nil
+	}
+
+	safeName := sanitizeName(name)
+	if safeName == "" {
+		return nil, nil, newRenderError(http.StatusBadRequest, "invalid template_name")
+	}
+
+	stored, err := resolveStoredTemplate(safeName, version)
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) {
+			return nil, nil, newRenderError(http.StatusNotFound, fmt.Sprintf("template %s not found", describeTemplateVersion(safeName, version)))
+		}
+		return nil, nil, newRenderError(http.StatusInternalServerError, err.Error())
+	}
+
+	tmpl, err := tmplCache.stored(stored)
+	if err != nil {
+		return nil, nil, newRenderError(http.StatusBadRequest, "template parse error: "+err.Error())
+	}
+	return tmpl, stored, nil
+}
+
+// validateRequestData checks a payload against the schema sidecar of a stored
+// template, if it has one. In strict mode violations are rejected with 422;
+// otherwise they are returned so the caller can report them alongside the render.
+func validateRequestData(ctx context.Context, stored *storedTemplate, data map[string]interface{}, strict bool) ([]SchemaViolation, error) {
+	if stored == nil {
+		return nil, nil
+	}
+
+	schema, err := loadTemplateSchema(stored)
+	if err != nil {
+		return nil, newRenderError(http.StatusInternalServerError, fmt.Sprintf("schema error for %s: %v", stored.Filename, err))
+	}
+	if schema == nil {
+		return nil, nil
+	}
+
+	violations := schema.validate(data)
+	if len(violations) > 0 {
+		slog.InfoContext(ctx, "payload has schema violations", "template", stored.Filename, "violations", len(violations))
+		if strict {
+			return nil, &renderError{
+				status: http.StatusUnprocessableEntity,
+				resp: RenderResponse{
+					TemplateName:    stored.Name,
+					TemplateVersion: stored.Version,
+					TemplateFile:    stored.Filename,
+					Violations:      violations,
+					Error:           "payload failed schema validation",
+				},
+			}
+		}
+	}
+	return violations, nil
+}
+
+// redactRequestData masks payload fields in place using the named redaction
+// profile and records what was masked in the render log
+func redactRequestData(ctx context.Context, profileName string, data map[string]interface{}) error {
+	var profile *RedactionProfile
+	if profiles := redactionProfiles.Load(); profiles != nil {
+		profile = (*profiles)[profileName]
+	}
+	if profile == nil {
+		return newRenderError(http.StatusBadRequest, fmt.Sprintf("unknown redaction_profile %q", profileName))
+	}
+
+	paths, count := profile.redact(data)
+	slog.InfoContext(ctx, "redaction profile applied", "profile", profileName, "masked", count, "paths", paths)
+	return nil
+}
+
+// describeTemplateVersion formats a template name and requested version for messages
+func describeTemplateVersion(name string, version *TemplateVersion) string {
+	if version == nil || version.Latest {
+		return name + " (latest)"
+	}
+	return fmt.Sprintf("%s version %d", name, version.Number)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchemaViolation describes one place where a payload doesn't match its template's schema
+type SchemaViolation struct {
+	Pointer  string `json:"pointer"`            // JSON pointer into data, e.g. /company/pic/name ("" is the root)
+	Expected string `json:"expected,omitempty"` // expected type or constraint
+	Message  string `json:"message"`
+}
+
+// jsonSchema is the subset of JSON Schema used to describe template payloads:
+// type, properties, required, additionalProperties, items, enum, const,
+// string length/pattern/format, numeric bounds and array length.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *schemaOrBool          `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Const                interface{}            `json:"const,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes accepts "type" as a single string or a list of strings
+type schemaTypes []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// schemaOrBool accepts additionalProperties as a boolean or a schema
+type schemaOrBool struct {
+	Allowed bool
+	Schema  *jsonSchema
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *schemaOrBool) UnmarshalJSON(b []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(b, &allowed); err == nil {
+		*s = schemaOrBool{Allowed: allowed}
+		return nil
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return err
+	}
+	*s = schemaOrBool{Allowed: true, Schema: &schema}
+	return nil
+}
+
+// schemaFilename returns the schema sidecar name for a template version,
+// next to the -vN.json sample data (e.g. data-application-company-v18.schema.json)
+func schemaFilename(name string, version int) string {
+	if version == 0 {
+		return name + ".schema.json"
+	}
+	return fmt.Sprintf("%s-v%d.schema.json", name, version)
+}
+
+// parseSchema decodes a JSON Schema and compiles its patterns
+func parseSchema(content []byte) (*jsonSchema, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(content, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := schema.compile("#"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// schemaEntry is a parsed schema along with the stamp it was parsed from
+type schemaEntry struct {
+	stamp  string // file modtime and size
+	schema *jsonSchema
+}
+
+// schemaCache holds the parsed schema sidecars by path. Like stored
+// templates in tmplCache, entries are revalidated against the file's modtime
+// and size, and dropped once the file is gone.
+var schemaCache = struct {
+	sync.Mutex
+	entries map[string]schemaEntry
+}{entries: make(map[string]schemaEntry)}
+
+// loadTemplateSchema returns the parsed schema sidecar of a stored template,
+// reading it again only when the file changed; it returns nil when the
+// template has no schema
+func loadTemplateSchema(st *storedTemplate) (*jsonSchema, error) {
+	path := filepath.Join(config.TemplatesDir, schemaFilename(st.Name, st.Version))
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			schemaCache.Lock()
+			delete(schemaCache.entries, path)
+			schemaCache.Unlock()
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	stamp := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+
+	schemaCache.Lock()
+	entry, ok := schemaCache.entries[path]
+	schemaCache.Unlock()
+	if ok && entry.stamp == stamp {
+		return entry.schema, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	schema, err := parseSchema(content)
+	if err != nil {
+		return nil, err
+	}
+	schemaCache.Lock()
+	schemaCache.entries[path] = schemaEntry{stamp: stamp, schema: schema}
+	schemaCache.Unlock()
+	return schema, nil
+}
+
+// compile validates regex patterns throughout the schema
+func (s *jsonSchema) compile(path string) error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern at %s: %w", path, err)
+		}
+		s.pattern = re
+	}
+	for name, prop := range s.Properties {
+		if err := prop.compile(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + "/items"); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		if err := s.AdditionalProperties.Schema.compile(path + "/additionalProperties"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks a decoded JSON value against the schema
+func (s *jsonSchema) validate(v interface{}) []SchemaViolation {
+	var violations []SchemaViolation
+	s.validateAt("", v, &violations)
+	return violations
+}
+
+func (s *jsonSchema) validateAt(pointer string, v interface{}, out *[]SchemaViolation) {
+	fail := func(expected, format string, args ...interface{}) {
+		*out = append(*out, SchemaViolation{
+			Pointer:  pointer,
+			Expected: expected,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(s.Type) > 0 && !matchesAnyType(v, s.Type) {
+		expected := strings.Join(s.Type, "|")
+		if v == nil {
+			fail(expected, "expected %s, got null", expected)
+		} else {
+			fail(expected, "expected %s, got %s", expected, jsonTypeOf(v))
+		}
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail(fmt.Sprintf("one of %v", s.Enum), "value %v is not allowed", v)
+		}
+	}
+	if s.Const != nil && !reflect.DeepEqual(s.Const, v) {
+		fail(fmt.Sprintf("%v", s.Const), "value must be %v", s.Const)
+	}
+
+	switch val := v.(type) {
+	case string:
+		n := len([]rune(val))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail(fmt.Sprintf("minLength %d", *s.MinLength), "string is shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail(fmt.Sprintf("maxLength %d", *s.MaxLength), "string is longer than %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("pattern "+s.Pattern, "string does not match pattern %s", s.Pattern)
+		}
+		if s.Format != "" && !matchesFormat(s.Format, val) {
+			fail("format "+s.Format, "string is not a valid %s", s.Format)
+		}
+
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			fail(fmt.Sprintf("minimum %v", *s.Minimum), "%v is less than %v", val, *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			fail(fmt.Sprintf("maximum %v", *s.Maximum), "%v is greater than %v", val, *s.Maximum)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			fail(fmt.Sprintf("minItems %d", *s.MinItems), "array has fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			fail(fmt.Sprintf("maxItems %d", *s.MaxItems), "array has more than %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range val {
+				s.Items.validateAt(fmt.Sprintf("%s/%d", pointer, i), item, out)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				expected := "present"
+				if prop := s.Properties[name]; prop != nil && len(prop.Type) > 0 {
+					expected = strings.Join(prop.Type, "|")
+				}
+				*out = append(*out, SchemaViolation{
+					Pointer:  pointer + "/" + escapePointer(name),
+					Expected: expected,
+					Message:  "required property is missing",
+				})
+			}
+		}
+
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			child := pointer + "/" + escapePointer(k)
+			if prop, ok := s.Properties[k]; ok {
+				prop.validateAt(child, val[k], out)
+				continue
+			}
+			if ap := s.AdditionalProperties; ap != nil {
+				if !ap.Allowed {
+					*out = append(*out, SchemaViolation{Pointer: child, Message: "property is not allowed"})
+				} else if ap.Schema != nil {
+					ap.Schema.validateAt(child, val[k], out)
+				}
+			}
+		}
+	}
+}
+
+// matchesAnyType reports whether v is one of the JSON Schema types
+func matchesAnyType(v interface{}, types []string) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf returns the JSON Schema type name of a decoded JSON value
+func jsonTypeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// matchesFormat checks the string formats used in payloads; unknown formats pass
+func matchesFormat(format, s string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "email":
+		_, err := mail.ParseAddress(s)
+		return err == nil
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	default:
+		return true
+	}
+}
+
+// escapePointer escapes a property name for use in a JSON pointer (RFC 6901)
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useTemplatesDir points the templates directory at dir for the test
+func useTemplatesDir(t *testing.T, dir string) {
+	t.Helper()
+	prev := config.TemplatesDir
+	t.Cleanup(func() { config.TemplatesDir = prev })
+	config.TemplatesDir = dir
+}
+
+// pointers returns the JSON pointers of violations
+func pointers(violations []SchemaViolation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Pointer)
+	}
+	return out
+}
+
+func TestStoredTemplateSchema(t *testing.T) {
+	useTemplatesDir(t, "testdata")
+
+	st, err := resolveStoredTemplate("zz-test", nil)
+	if err != nil {
+		t.Fatalf("resolve template: %v", err)
+	}
+	schema, err := loadTemplateSchema(st)
+	if err != nil || schema == nil {
+		t.Fatalf("load schema: %v, %v", schema, err)
+	}
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want []string
+	}{
+		{
+			name: "valid",
+			data: map[string]interface{}{
+				"lead_id": "L-123",
+				"company": map[string]interface{}{"pic": map[string]interface{}{"name": "Budi"}},
+				"banks":   []interface{}{map[string]interface{}{"account_number": "0123"}},
+			},
+		},
+		{
+			name: "missing required",
+			data: map[string]interface{}{"lead_id": "L-123", "company": map[string]interface{}{}},
+			want: []string{"/company/pic"},
+		},
+		{
+			name: "wrong types and lengths",
+			data: map[string]interface{}{
+				"lead_id": "L1",
+				"company": map[string]interface{}{"pic": map[string]interface{}{"name": 42.0}},
+				"banks":   []interface{}{map[string]interface{}{}, "x"},
+			},
+			want: []string{"/banks/0/account_number", "/banks/1", "/company/pic/name", "/lead_id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pointers(schema.validate(tt.data))
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("violations at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRequestDataStrict(t *testing.T) {
+	useTemplatesDir(t, "testdata")
+
+	st, err := resolveStoredTemplate("zz-test", nil)
+	if err != nil {
+		t.Fatalf("resolve template: %v", err)
+	}
+	data := map[string]interface{}{"lead_id": "L-123"}
+
+	violations, err := validateRequestData(context.Background(), st, data, false)
+	if err != nil || len(violations) != 1 {
+		t.Fatalf("lenient: got %v, %v; want one violation and no error", violations, err)
+	}
+
+	_, err = validateRequestData(context.Background(), st, data, true)
+	var re *renderError
+	if !errors.As(err, &re) || re.status != http.StatusUnprocessableEntity {
+		t.Fatalf("strict: got %v, want a 422 render error", err)
+	}
+}
+
+func TestSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  interface{}
+		ok     bool
+	}{
+		{"type list", `{"type":["string","null"]}`, nil, true},
+		{"integer is a number", `{"type":"number"}`, 3.0, true},
+		{"number is not an integer", `{"type":"integer"}`, 3.5, false},
+		{"enum", `{"enum":["PT","CV"]}`, "UD", false},
+		{"const", `{"const":"IDR"}`, "IDR", true},
+		{"pattern", `{"type":"string","pattern":"^[0-9]{16}$"}`, "12345", false},
+		{"maxLength counts runes", `{"maxLength":4}`, "Café", true},
+		{"minimum", `{"minimum":1}`, 0.0, false},
+		{"maxItems", `{"maxItems":1}`, []interface{}{1.0, 2.0}, false},
+		{"format date", `{"format":"date"}`, "2024-02-30", false},
+		{"format email", `{"format":"email"}`, "pic@example.co.id", true},
+		{"unknown format passes", `{"format":"npwp"}`, "anything", true},
+		{"closed object", `{"additionalProperties":false,"properties":{"a":{}}}`, map[string]interface{}{"a": 1.0, "b": 2.0}, false},
+		{"additionalProperties schema", `{"additionalProperties":{"type":"string"}}`, map[string]interface{}{"x": "y"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := parseSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			violations := schema.validate(tt.value)
+			if ok := len(violations) == 0; ok != tt.ok {
+				t.Errorf("valid = %v, want %v (violations %v)", ok, tt.ok, violations)
+			}
+		})
+	}
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`{"type":`,
+		`{"properties":{"nik":{"pattern":"([0-9]"}}}`,
+		`{"type":7}`,
+	} {
+		if _, err := parseSchema([]byte(schema)); err == nil {
+			t.Errorf("parseSchema(%s) succeeded, want an error", schema)
+		}
+	}
+}
+
+func TestTemplateSchemaCached(t *testing.T) {
+	dir := t.TempDir()
+	useTemplatesDir(t, dir)
+	write := func(name, content string, mtime time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("offer-v1.html", "<p>{{.name}}</p>", now)
+	write("offer-v1.schema.json", `{"required": ["name"]}`, now)
+
+	st, err := resolveStoredTemplate("offer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := loadTemplateSchema(st)
+	if err != nil || first == nil {
+		t.Fatalf("load schema: %v, %v", first, err)
+	}
+	if again, _ := loadTemplateSchema(st); again != first {
+		t.Error("unchanged schema was parsed again")
+	}
+
+	// A changed sidecar is read again
+	write("offer-v1.schema.json", `{"required": ["name", "price"]}`, now.Add(time.Minute))
+	changed, err := loadTemplateSchema(st)
+	if err != nil || changed == first || !slices.Equal(changed.Required, []string{"name", "price"}) {
+		t.Errorf("changed schema = %+v, %v", changed, err)
+	}
+
+	// A removed sidecar means no schema
+	if err := os.Remove(filepath.Join(dir, "offer-v1.schema.json")); err != nil {
+		t.Fatal(err)
+	}
+	if gone, err := loadTemplateSchema(st); gone != nil || err != nil {
+		t.Errorf("removed schema = %+v, %v", gone, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// draining is set once shutdown starts so /readyz takes the instance out of rotation
+var draining atomic.Bool
+
+// staleTempAge is how old an unowned temp file must be before the startup
+// sweep removes it, so files of another instance still writing are left alone
+const staleTempAge = 10 * time.Minute
+
+// newServer creates an HTTP server with the configured timeouts
+func newServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serve runs srv in the background, exiting the process if it fails to listen
+func serve(name string, srv *http.Server) {
+	go func() {
+		slog.Info(name+" listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fatal(name+" server failed", "error", err)
+		}
+	}()
+}
+
+// shutdown stops the servers from accepting connections and waits, up to the
+// configured deadline, for in-flight requests and running jobs to finish.
+// Then it stops Chrome, killing browsers still rendering, flushes traces and
+// removes temp files.
+func shutdown(servers []*http.Server, shutdownTracing func(context.Context) error) {
+	draining.Store(true)
+	slog.Info("shutting down, draining in-flight renders", "timeout", config.Server.ShutdownTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("requests still running at shutdown deadline, closing connections", "addr", srv.Addr, "error", err)
+				srv.Close()
+			}
+		})
+	}
+	wg.Go(func() {
+		if err := jobs.Close(ctx); err != nil {
+			slog.Warn("jobs still running at shutdown deadline", "error", err)
+		}
+	})
+	wg.Wait()
+
+	if err := pdfPool.Close(ctx); err != nil {
+		slog.Error("failed to stop chrome pool", "error", err)
+	}
+
+	// Export the spans of the drained requests even if the deadline has passed
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+
+	sweepTempFiles()
+	slog.Info("shutdown complete")
+}
+
+// sweepTempFiles removes temp files left behind by a crash: Chrome profile
+// directories whose browser is gone, half-written atomic writes in the
+// templates and job directories, and HTML files of releases that rendered
+// from disk.
+func sweepTempFiles() {
+	removed := 0
+	remove := func(path string) {
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("failed to remove stale temp file", "path", path, "error", err)
+			return
+		}
+		removed++
+	}
+
+	tmp := os.TempDir()
+	dirs, _ := filepath.Glob(filepath.Join(tmp, "chromedp-runner*"))
+	for _, dir := range dirs {
+		if !chromeProfileInUse(dir) {
+			remove(dir)
+		}
+	}
+
+	var stale []string
+	legacy, _ := filepath.Glob(filepath.Join(tmp, "pdf-render-*.html"))
+	stale = append(stale, legacy...)
+	for _, dir := range []string{config.TemplatesDir, config.Jobs.Dir} {
+		partial, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+		stale = append(stale, partial...)
+	}
+	for _, path := range stale {
+		if olderThan(path, staleTempAge) {
+			remove(path)
+		}
+	}
+
+	if removed > 0 {
+		slog.Info("removed stale temp files", "count", removed)
+	}
+}
+
+// chromeProfileInUse reports whether a Chrome profile directory may belong to
+// a running browser. Chrome holds a SingletonLock symlink to "hostname-pid"
+// while it runs; a profile without one is only in use while it is new.
+func chromeProfileInUse(dir string) bool {
+	lock, err := os.Readlink(filepath.Join(dir, "SingletonLock"))
+	if err != nil {
+		return !olderThan(dir, staleTempAge)
+	}
+	i := strings.LastIndex(lock, "-")
+	pid, err := strconv.Atoi(lock[i+1:])
+	if err != nil {
+		return true
+	}
+	if host, _ := os.Hostname(); lock[:max(i, 0)] != host {
+		return true
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// olderThan reports whether path was last modified more than age ago
+func olderThan(path string, age time.Duration) bool {
+	info, err := os.Lstat(path)
+	return err == nil && time.Since(info.ModTime()) > age
+}
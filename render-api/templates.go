@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionPattern matches versioned template files like data-application-v3.html
+var versionPattern = regexp.MustCompile(`^(.+)-v(\d+)\.html$`)
+
+// errTemplateNotFound is returned when a stored template or version doesn't exist
+var errTemplateNotFound = errors.New("template not found")
+
+// errVersionConflict is returned when concurrent saves of a template keep
+// taking the version numbers a save tries to commit
+var errVersionConflict = errors.New("version conflict: the template is being saved concurrently, try again")
+
+// maxVersionAttempts bounds how often a save moves on to the next version
+// number after losing one to a concurrent save
+const maxVersionAttempts = 10
+
+// errTemplateArchived is returned when archiving a version whose file name is
+// already taken in the archive
+var errTemplateArchived = errors.New("template version is already archived")
+
+// TemplateVersion selects a stored template version. It accepts a number
+// (18), a string ("18", "v18") or "latest" in JSON.
+type TemplateVersion struct {
+	Number int
+	Latest bool
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *TemplateVersion) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("version must not be negative")
+		}
+		*v = TemplateVersion{Number: n}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("version must be a number or \"latest\"")
+	}
+	parsed, err := parseTemplateVersion(s)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+// parseTemplateVersion parses a version given as text: "18", "v18" or
+// "latest". An empty string means latest.
+func parseTemplateVersion(s string) (TemplateVersion, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "latest" {
+		return TemplateVersion{Latest: true}, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "v"))
+	if err != nil || n < 0 {
+		return TemplateVersion{}, fmt.Errorf("invalid version %q", s)
+	}
+	return TemplateVersion{Number: n}, nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (v TemplateVersion) MarshalJSON() ([]byte, error) {
+	if v.Latest {
+		return json.Marshal("latest")
+	}
+	return json.Marshal(v.Number)
+}
+
+// archiveDir is the subdirectory of the templates directory that archived
+// versions are moved to
+const archiveDir = "archive"
+
+// storedTemplate is a template file resolved from the templates directory
+type storedTemplate struct {
+	Name     string
+	Filename string
+	Version  int
+	ModTime  time.Time
+	Size     int64
+	Archived bool // moved to the archive; not rendered by name
+}
+
+// dir returns the directory holding the template and its sidecars
+func (st *storedTemplate) dir() string {
+	if st.Archived {
+		return filepath.Join(config.TemplatesDir, archiveDir)
+	}
+	return config.TemplatesDir
+}
+
+// readFiles reads the template file and its data and schema sidecars, in the
+// order of templateFiles. A missing sidecar is returned as nil.
+func (st *storedTemplate) readFiles() ([][]byte, error) {
+	filenames := templateFiles(st.Name, st.Version)
+	files := make([][]byte, len(filenames))
+	for i, filename := range filenames {
+		content, err := os.ReadFile(filepath.Join(st.dir(), filename))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		files[i] = content
+	}
+	return files, nil
+}
+
+// templateFilename returns the file name for a template version; version 0
+// is the unversioned file (e.g. data-application-company.html)
+func templateFilename(name string, version int) string {
+	if version == 0 {
+		return name + ".html"
+	}
+	return fmt.Sprintf("%s-v%d.html", name, version)
+}
+
+// parseTemplateFilename splits the file name of a stored template, such as
+// data-application-v3.html, into its name and version. Anything that isn't
+// exactly the file name of a template version, paths included, is rejected.
+func parseTemplateFilename(filename string) (string, int, bool) {
+	name, ok := strings.CutSuffix(filename, ".html")
+	if !ok {
+		return "", 0, false
+	}
+	version := 0
+	if matches := versionPattern.FindStringSubmatch(filename); matches != nil {
+		name = matches[1]
+		version, _ = strconv.Atoi(matches[2])
+	}
+	if name == "" || sanitizeName(name) != name || templateFilename(name, version) != filename {
+		return "", 0, false
+	}
+	return name, version, true
+}
+
+// dataFilename returns the file name of the sample data saved with a template version
+func dataFilename(name string, version int) string {
+	if version == 0 {
+		return name + ".json"
+	}
+	return fmt.Sprintf("%s-v%d.json", name, version)
+}
+
+// templateFiles returns the template file of a version followed by its data,
+// schema and metadata sidecars
+func templateFiles(name string, version int) []string {
+	return []string{templateFilename(name, version), dataFilename(name, version), schemaFilename(name, version), metaFilename(name, version)}
+}
+
+// templateVersions returns the stored versions of a template in ascending order
+func templateVersions(name string) ([]int, error) {
+	return versionsIn(config.TemplatesDir, name)
+}
+
+// archivedVersions returns the archived versions of a template in ascending order
+func archivedVersions(name string) ([]int, error) {
+	versions, err := versionsIn(filepath.Join(config.TemplatesDir, archiveDir), name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return versions, err
+}
+
+// versionsIn returns the versions of a template found in dir in ascending order
+func versionsIn(dir, name string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if entry.Name() == templateFilename(name, 0) {
+			versions = append(versions, 0)
+			continue
+		}
+		matches := versionPattern.FindStringSubmatch(entry.Name())
+		if matches != nil && matches[1] == name {
+			v, _ := strconv.Atoi(matches[2])
+			versions = append(versions, v)
+		}
+	}
+
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// resolveStoredTemplate finds a template by name and version in the templates
+// directory without reading it. A nil version resolves to the latest one: the
+// published version if there is one, otherwise the highest.
+func resolveStoredTemplate(name string, version *TemplateVersion) (*storedTemplate, error) {
+	versions, err := templateVersions(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTemplateNotFound
+		}
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+	if len(versions) == 0 {
+		return nil, errTemplateNotFound
+	}
+
+	v := versions[len(versions)-1]
+	if version != nil && !version.Latest {
+		v = version.Number
+	} else if published, ok, err := publishedVersion(name, versions); err != nil {
+		return nil, err
+	} else if ok {
+		v = published
+	}
+
+	filename := templateFilename(name, v)
+	fi, err := os.Stat(filepath.Join(config.TemplatesDir, filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTemplateNotFound
+		}
+		return nil, fmt.Errorf("failed to stat template file: %w", err)
+	}
+
+	return &storedTemplate{
+		Name:     name,
+		Filename: filename,
+		Version:  v,
+		ModTime:  fi.ModTime(),
+		Size:     fi.Size(),
+	}, nil
+}
+
+// findTemplateVersion resolves a template like resolveStoredTemplate, but an
+// explicit version number that has been archived is found in the archive
+func findTemplateVersion(name string, version TemplateVersion) (*storedTemplate, error) {
+	st, err := resolveStoredTemplate(name, &version)
+	if !errors.Is(err, errTemplateNotFound) || version.Latest {
+		return st, err
+	}
+
+	filename := templateFilename(name, version.Number)
+	fi, err := os.Stat(filepath.Join(config.TemplatesDir, archiveDir, filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTemplateNotFound
+		}
+		return nil, fmt.Errorf("failed to stat archived template file: %w", err)
+	}
+	return &storedTemplate{
+		Name:     name,
+		Filename: filename,
+		Version:  version.Number,
+		ModTime:  fi.ModTime(),
+		Size:     fi.Size(),
+		Archived: true,
+	}, nil
+}
+
+// archiveTemplate moves a template version and its sidecars into the archive.
+// The template file goes first, so the version stops resolving for renders
+// even if a sidecar can't be moved.
+func archiveTemplate(st *storedTemplate) error {
+	dir := filepath.Join(config.TemplatesDir, archiveDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, st.Filename)); err == nil {
+		return errTemplateArchived
+	}
+
+	for i, filename := range templateFiles(st.Name, st.Version) {
+		err := os.Rename(filepath.Join(config.TemplatesDir, filename), filepath.Join(dir, filename))
+		if err == nil || (i > 0 && os.IsNotExist(err)) {
+			continue
+		}
+		if i == 0 {
+			return fmt.Errorf("failed to archive template: %w", err)
+		}
+		slog.Warn("failed to archive template sidecar", "file", filename, "error", err)
+	}
+	return nil
+}
+
+// saveTemplateVersion stores files, ordered as templateFiles with nil for a
+// missing sidecar, as the next version of a template and returns its number.
+//
+// Each file is written to a temp file first, so a crash never leaves a
+// truncated file under a version's name. The version is then claimed by hard
+// linking the temp files to their final names, which fails rather than
+// overwrites when a concurrent save (in this or another process) got there
+// first. Sidecars are linked before the template file, since the template
+// file is what makes a version visible; when any link fails the ones made so
+// far are removed and the next version number is tried.
+func saveTemplateVersion(name string, files [][]byte) (int, error) {
+	if err := os.MkdirAll(config.TemplatesDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create templates directory: %w", err)
+	}
+
+	staged := make([]string, len(files))
+	defer func() {
+		for _, tmp := range staged {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+	}()
+	for i, filename := range templateFiles(name, 0) {
+		if files[i] == nil {
+			continue
+		}
+		tmp, err := writeTempFile(filepath.Join(config.TemplatesDir, filename), files[i], 0644)
+		if err != nil {
+			return 0, err
+		}
+		staged[i] = tmp
+	}
+
+	version := 0
+	for range maxVersionAttempts {
+		// A sidecar orphaned by a crash can hold a number the directory scan
+		// doesn't see, so never retry the same one
+		version = max(getNextVersion(name), version+1)
+		err := linkTemplateVersion(name, version, staged)
+		if err == nil {
+			return version, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return 0, err
+		}
+	}
+	return 0, errVersionConflict
+}
+
+// linkTemplateVersion links staged files to the names of a version, the
+// template file last. On failure it removes the links it made.
+func linkTemplateVersion(name string, version int, staged []string) error {
+	filenames := templateFiles(name, version)
+	var linked []string
+	for i := len(staged) - 1; i >= 0; i-- {
+		if staged[i] == "" {
+			continue
+		}
+		path := filepath.Join(config.TemplatesDir, filenames[i])
+		if err := os.Link(staged[i], path); err != nil {
+			for _, p := range linked {
+				os.Remove(p)
+			}
+			if errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			return fmt.Errorf("failed to save %s: %w", filenames[i], err)
+		}
+		linked = append(linked, path)
+	}
+	return nil
+}
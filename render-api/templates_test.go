@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSaveTemplateVersionConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	useTemplatesDir(t, dir)
+
+	const saves = 24
+	versions := make([]int, saves)
+	errs := make([]error, saves)
+	var wg sync.WaitGroup
+	for i := range saves {
+		wg.Go(func() {
+			html := []byte(fmt.Sprintf("<p>save %d</p>", i))
+			meta, err := newTemplateMeta(html, "test", fmt.Sprintf("save %d", i), nil, StatusDraft).encode()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			data := []byte(fmt.Sprintf(`{"save":%d}`, i))
+			versions[i], errs[i] = saveTemplateVersion("offer", [][]byte{html, data, nil, meta})
+		})
+	}
+	wg.Wait()
+
+	seen := make(map[int]int)
+	for i, v := range versions {
+		if errs[i] != nil {
+			t.Fatalf("save %d: %v", i, errs[i])
+		}
+		if prev, ok := seen[v]; ok {
+			t.Fatalf("saves %d and %d both got version %d", prev, i, v)
+		}
+		seen[v] = i
+	}
+
+	for v, i := range seen {
+		files := templateFiles("offer", v)
+		html, err := os.ReadFile(filepath.Join(dir, files[0]))
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if want := fmt.Sprintf("<p>save %d</p>", i); string(html) != want {
+			t.Errorf("%s = %q, want %q", files[0], html, want)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, files[1]))
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if want := fmt.Sprintf(`{"save":%d}`, i); string(data) != want {
+			t.Errorf("%s = %q, want %q", files[1], data, want)
+		}
+		meta, err := readTemplateMeta(dir, "offer", v)
+		if err != nil || meta == nil {
+			t.Fatalf("version %d metadata: %v, %v", v, meta, err)
+		}
+		if want := fmt.Sprintf("save %d", i); meta.Message != want {
+			t.Errorf("%s message = %q, want %q", files[3], meta.Message, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, files[2])); !os.IsNotExist(err) {
+			t.Errorf("%s exists but no schema was saved", files[2])
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("temp file %s left behind", entry.Name())
+		}
+	}
+	if want := saves * 3; len(entries) != want {
+		t.Errorf("directory holds %d files, want %d", len(entries), want)
+	}
+}
+
+func TestPublishTemplateRollback(t *testing.T) {
+	dir := t.TempDir()
+	useTemplatesDir(t, dir)
+
+	for i := 1; i <= 3; i++ {
+		html := []byte(fmt.Sprintf("<p>v%d</p>", i))
+		meta, err := newTemplateMeta(html, "", "", nil, StatusApproved).encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := saveTemplateVersion("offer", [][]byte{html, nil, nil, meta}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish := func(v int) {
+		t.Helper()
+		st, err := resolveStoredTemplate("offer", &TemplateVersion{Number: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := publishTemplate(st); err != nil {
+			t.Fatalf("publish v%d: %v", v, err)
+		}
+	}
+	latest := func() int {
+		t.Helper()
+		st, err := resolveStoredTemplate("offer", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Version
+	}
+
+	if v := latest(); v != 3 {
+		t.Fatalf("latest before publishing = v%d, want v3", v)
+	}
+	publish(3)
+	publish(1) // roll back
+	if v := latest(); v != 1 {
+		t.Errorf("latest after rolling back = v%d, want v1", v)
+	}
+	for v, want := range map[int]string{1: StatusPublished, 2: StatusApproved, 3: StatusDeprecated} {
+		meta, err := readTemplateMeta(dir, "offer", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Status != want {
+			t.Errorf("v%d status = %s, want %s", v, meta.Status, want)
+		}
+	}
+
+	// A publish interrupted after moving the pointer: the pointer decides
+	if err := os.WriteFile(filepath.Join(dir, publishedFilename("offer")), []byte("2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if v := latest(); v != 2 {
+		t.Errorf("latest = v%d, want v2 from the pointer", v)
+	}
+	for v, want := range map[int]string{1: StatusDeprecated, 2: StatusPublished} {
+		meta, err := readTemplateMeta(dir, "offer", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reconcileStatus(meta, "offer", v, false); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Status != want {
+			t.Errorf("v%d reconciled status = %s, want %s", v, meta.Status, want)
+		}
+	}
+}
+
+func TestParseTemplateFilename(t *testing.T) {
+	for _, tt := range []struct {
+		filename string
+		name     string
+		version  int
+		ok       bool
+	}{
+		{"data-application-v3.html", "data-application", 3, true},
+		{"invoice.html", "invoice", 0, true},
+		{"../config.yaml", "", 0, false},
+		{"../../etc/passwd.html", "", 0, false},
+		{"archive/offer-v1.html", "", 0, false},
+		{"offer-v01.html", "", 0, false},
+		{"offer-v1.json", "", 0, false},
+		{"Offer-v1.html", "", 0, false},
+		{".html", "", 0, false},
+	} {
+		name, version, ok := parseTemplateFilename(tt.filename)
+		if name != tt.name || version != tt.version || ok != tt.ok {
+			t.Errorf("parseTemplateFilename(%q) = %q, %d, %v; want %q, %d, %v",
+				tt.filename, name, version, ok, tt.name, tt.version, tt.ok)
+		}
+	}
+}
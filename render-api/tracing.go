@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the render pipeline. Until setupTracing installs
+// a provider it produces no-op spans.
+var tracer = otel.Tracer("render-api")
+
+// setupTracing installs the configured span exporter and the W3C trace context
+// propagator. It returns a function that flushes and stops the exporter.
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	// Propagate traceparent even when spans aren't exported, so callers'
+	// traces continue through to DMS and webhook receivers
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var opt sdktrace.TracerProviderOption
+	switch cfg.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		// Endpoint, headers and TLS come from the standard OTEL_EXPORTER_OTLP_* variables
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+		}
+		opt = sdktrace.WithBatcher(exp)
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		opt = sdktrace.WithSyncer(exp)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (want otlp, stdout or none)", cfg.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	// The sampler follows OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+	tp := sdktrace.NewTracerProvider(opt, sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	slog.Info("tracing enabled", "exporter", cfg.Exporter, "service", cfg.ServiceName)
+	return tp.Shutdown, nil
+}
+
+// withTracing wraps a handler in a server span named after its route,
+// continuing the trace of an incoming traceparent header
+func withTracing(route string, next http.HandlerFunc) http.HandlerFunc {
+	return otelhttp.NewHandler(next, route).ServeHTTP
+}
+
+// tracedTransport wraps an HTTP transport so outgoing requests get a client
+// span and a traceparent header
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedAction runs a chromedp action in a child span of parent. chromedp
+// runs actions with the browser tab's context, so the parent span is passed
+// separately.
+func tracedAction(parent context.Context, name string, action chromedp.Action, attrs ...attribute.KeyValue) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		_, span := tracer.Start(parent, "chromedp."+name, trace.WithAttributes(attrs...))
+		err := action.Do(ctx)
+		endSpan(span, err)
+		return err
+	}
+}
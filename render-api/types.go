@@ -1,22 +1,40 @@
 package main
 
+import "time"
+
 // RenderRequest represents a template rendering request
 type RenderRequest struct {
-	Template string                 `json:"template"`
-	Data     map[string]interface{} `json:"data"`
+	Template     string                 `json:"template,omitempty"`
+	TemplateName string                 `json:"template_name,omitempty"` // stored template to render instead of template
+	Version      *TemplateVersion       `json:"version,omitempty"`       // stored template version or "latest" (default)
+	Data         map[string]interface{} `json:"data"`
+	Strict       bool                   `json:"strict,omitempty"`            // reject payloads that fail schema validation with 422
+	Redaction    string                 `json:"redaction_profile,omitempty"` // mask payload fields using a configured profile
 }
 
 // RenderResponse represents a template rendering response
 type RenderResponse struct {
-	HTML  string `json:"html,omitempty"`
-	Error string `json:"error,omitempty"`
+	HTML            string            `json:"html,omitempty"`
+	TemplateName    string            `json:"template_name,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty"`
+	TemplateFile    string            `json:"template_file,omitempty"`
+	Violations      []SchemaViolation `json:"violations,omitempty"`
+	Redaction       string            `json:"redaction_profile,omitempty"`
+	Error           string            `json:"error,omitempty"`
 }
 
 // SaveRequest represents a template save request
 type SaveRequest struct {
 	Name     string `json:"name"`
 	Template string `json:"template"`
-	Data     string `json:"data,omitempty"` // optional JSON data to save alongside
+	Data     string `json:"data,omitempty"`   // optional JSON data to save alongside
+	Schema   string `json:"schema,omitempty"` // optional JSON Schema for the data payload
+
+	// Recorded in the version's metadata
+	Author  string   `json:"author,omitempty"` // defaults to the authenticated client
+	Message string   `json:"message,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Status  string   `json:"status,omitempty"` // draft (default) or approved
 }
 
 // SaveResponse represents a template save response
@@ -37,6 +55,24 @@ type TemplateInfo struct {
 	Name     string `json:"name"`
 	Filename string `json:"filename"`
 	Version  int    `json:"version"`
+	Archived bool   `json:"archived,omitempty"`
+	*TemplateMeta
+}
+
+// TemplateVersionResponse is returned by the template version endpoints: a
+// stored version with its content, or the outcome of archiving or restoring one
+type TemplateVersionResponse struct {
+	Name         string    `json:"name,omitempty"`
+	Version      int       `json:"version,omitempty"`
+	Filename     string    `json:"filename,omitempty"`
+	Archived     bool      `json:"archived,omitempty"`
+	RestoredFrom *int      `json:"restored_from,omitempty"`
+	Modified     time.Time `json:"modified,omitzero"`
+	Template     string    `json:"template,omitempty"`
+	Data         string    `json:"data,omitempty"`   // sample JSON data saved with the version
+	Schema       string    `json:"schema,omitempty"` // JSON Schema saved with the version
+	*TemplateMeta
+	Error string `json:"error,omitempty"`
 }
 
 // UploadDMSRequest represents a DMS upload request
@@ -51,10 +87,67 @@ type UploadDMSRequest struct {
 
 // PDFRequest represents a PDF generation request
 type PDFRequest struct {
-	Template      string                 `json:"template"`
+	Template      string                 `json:"template,omitempty"`
+	TemplateName  string                 `json:"template_name,omitempty"` // stored template to render instead of template
+	Version       *TemplateVersion       `json:"version,omitempty"`       // stored template version or "latest" (default)
 	Data          map[string]interface{} `json:"data"`
-	Filename      string                 `json:"filename,omitempty"`        // optional filename for download
-	WaitAfterLoad int                    `json:"wait_after_load,omitempty"` // milliseconds to wait for images to load (default: 500)
+	Filename      string                 `json:"filename,omitempty"`          // optional filename for download
+	WaitAfterLoad int                    `json:"wait_after_load,omitempty"`   // extra milliseconds to wait after the page has loaded (default: 0)
+	WaitTimeout   int                    `json:"wait_timeout,omitempty"`      // longest wait in milliseconds for the page to load (default and max: PDF_WAIT_TIMEOUT_MS)
+	Strict        bool                   `json:"strict,omitempty"`            // reject payloads that fail schema validation with 422
+	Redaction     string                 `json:"redaction_profile,omitempty"` // mask payload fields using a configured profile
+	PDFOptions    *PDFOptions            `json:"pdf_options,omitempty"`       // Chrome print settings (paper, margins, scale...)
+	Header        string                 `json:"header,omitempty"`            // running page header template (default: the template's "pdf-header")
+	Footer        string                 `json:"footer,omitempty"`            // running page footer template (default: the template's "pdf-footer")
+	InlineImages  *bool                  `json:"inline_images,omitempty"`     // download remote images into the payload before rendering (default: IMAGE_INLINE)
+
+	// Webhook notification for asynchronous renders
+	CallbackURL    string `json:"callback_url,omitempty"`    // POSTed to when the job finishes; makes /render/pdf asynchronous
+	CallbackSecret string `json:"callback_secret,omitempty"` // HMAC-SHA256 signing secret (default: WEBHOOK_SECRET)
+	CallbackInline bool   `json:"callback_inline,omitempty"` // include the PDF as base64 in the webhook
+}
+
+// BatchRequest represents a batch PDF generation request
+type BatchRequest struct {
+	Items       []PDFRequest `json:"items"`
+	Output      string       `json:"output,omitempty"`      // "zip" (default) or "merged"
+	Filename    string       `json:"filename,omitempty"`    // optional filename for the zip or merged pdf (default: batch)
+	Concurrency int          `json:"concurrency,omitempty"` // renders in flight, capped at BATCH_CONCURRENCY
+}
+
+// BatchItemResult reports the outcome of one batch item
+type BatchItemResult struct {
+	Index          int             `json:"index"`
+	Filename       string          `json:"filename"`
+	Status         string          `json:"status"` // "ok" or "failed"
+	Size           int             `json:"size,omitempty"`
+	TemplateFile   string          `json:"template_file,omitempty"`
+	ResourceErrors []ResourceError `json:"resource_errors,omitempty"` // page resources that failed to load
+	Error          string          `json:"error,omitempty"`
+}
+
+// BatchResponse represents a batch manifest or error response
+type BatchResponse struct {
+	Items []BatchItemResult `json:"items,omitempty"`
+	Error string            `json:"error,omitempty"`
+}
+
+// JobResponse represents an asynchronous job status response
+type JobResponse struct {
+	ID              string          `json:"id,omitempty"`
+	Status          JobStatus       `json:"status,omitempty"`
+	Filename        string          `json:"filename,omitempty"`
+	Size            int             `json:"size,omitempty"`
+	SHA256          string          `json:"sha256,omitempty"`
+	TemplateFile    string          `json:"template_file,omitempty"`
+	TemplateVersion int             `json:"template_version,omitempty"`
+	ResourceErrors  []ResourceError `json:"resource_errors,omitempty"` // page resources that failed to load
+	CreatedAt       time.Time       `json:"created_at,omitzero"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+	ResultURL       string          `json:"result_url,omitempty"` // download link once the job is done
+	Callback        *CallbackState  `json:"callback,omitempty"`   // webhook delivery attempts
+	Error           string          `json:"error,omitempty"`      // request error, or why the job failed
 }
 
 // UploadDMSResponse represents a DMS upload response
@@ -3,18 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // writeJSON writes a JSON response with the given status code
@@ -24,6 +26,39 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// decodeStatus is the status code for a request body that failed to decode:
+// 413 when it is larger than server.max_body_bytes, else 400
+func decodeStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// maxErrorHeaderBytes bounds the JSON lists of errors sent in response
+// headers. Proxies commonly reject responses with more than 8 KiB of headers.
+const maxErrorHeaderBytes = 4 << 10
+
+// headerList encodes as many leading items as fit in maxErrorHeaderBytes as a
+// JSON array, for a header that sits next to one giving the full count
+func headerList[T any](items []T) string {
+	var list strings.Builder
+	list.WriteString("[")
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil || list.Len()+len(b)+2 > maxErrorHeaderBytes {
+			break
+		}
+		if list.Len() > 1 {
+			list.WriteString(",")
+		}
+		list.Write(b)
+	}
+	list.WriteString("]")
+	return list.String()
+}
+
 // sanitizeName converts a name to a safe filename
 func sanitizeName(name string) string {
 	// Convert to lowercase and replace spaces with dashes
@@ -41,44 +76,62 @@ func sanitizeName(name string) string {
 	return strings.Trim(name, "-")
 }
 
-// getNextVersion finds the next version number for a template
+// getNextVersion finds the next version number for a template. Archived
+// versions count too, so a number is never reused.
 func getNextVersion(baseName string) int {
-	entries, err := os.ReadDir(config.TemplatesDir)
-	if err != nil {
-		return 1
+	versions, _ := templateVersions(baseName)
+	archived, _ := archivedVersions(baseName)
+	next := 1
+	for _, v := range append(versions, archived...) {
+		next = max(next, v+1)
 	}
+	return next
+}
 
-	maxVersion := 0
-	pattern := regexp.MustCompile(fmt.Sprintf(`^%s-v(\d+)\.html$`, regexp.QuoteMeta(baseName)))
-
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		matches := pattern.FindStringSubmatch(entry.Name())
-		if matches != nil {
-			v, _ := strconv.Atoi(matches[1])
-			if v > maxVersion {
-				maxVersion = v
-			}
-		}
+// writeFileAtomic writes content to a temp file in the same directory and renames
+// it into place, so readers never see a partially written file
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmpPath, err := writeTempFile(path, content, perm)
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmpPath)
 
-	return maxVersion + 1
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
 }
 
-// saveFile saves content to a file in the templates directory
-func saveFile(filename string, content []byte) error {
-	if err := os.MkdirAll(config.TemplatesDir, 0755); err != nil {
-		return fmt.Errorf("failed to create templates directory: %w", err)
+// writeTempFile writes and syncs content to a temp file next to path, named
+// so the startup sweep removes it if the process dies before it's moved into
+// place. The caller removes it.
+func writeTempFile(path string, content []byte, perm os.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
+	tmpPath := tmp.Name()
 
-	filePath := filepath.Join(config.TemplatesDir, filename)
-	if err := os.WriteFile(filePath, content, 0644); err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+	fail := func(format string, err error) (string, error) {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return "", fmt.Errorf(format, err)
 	}
-
-	return nil
+	if _, err := tmp.Write(content); err != nil {
+		return fail("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fail("failed to set file mode: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to close temp file: %w", err)
+	}
+	return tmpPath, nil
 }
 
 // readTemplateFile reads a template file from the templates directory
@@ -87,12 +140,12 @@ func readTemplateFile(filename string) ([]byte, error) {
 	return os.ReadFile(filePath)
 }
 
-// isURLString checks if a string looks like a URL that should be marked as safe
+// isURLString checks if a string looks like a URL that should be marked as safe.
+// file:// URLs are handled separately by sanitizeValue.
 func isURLString(s string) bool {
 	return strings.HasPrefix(s, "http://") ||
 		strings.HasPrefix(s, "https://") ||
-		strings.HasPrefix(s, "data:") ||
-		strings.HasPrefix(s, "file://")
+		strings.HasPrefix(s, "data:")
 }
 
 // sanitizeDataForTemplate recursively converts URL-like strings to template.URL
@@ -111,6 +164,12 @@ func sanitizeValue(v interface{}) interface{} {
 		if isURLString(val) {
 			return template.URL(val)
 		}
+		// Local files are only reachable inside the assets directory
+		if strings.HasPrefix(val, "file://") {
+			if assetURL, ok := policy.assetURL(val); ok {
+				return template.URL(assetURL)
+			}
+		}
 		return val
 	case map[string]interface{}:
 		return sanitizeDataForTemplate(val)
@@ -125,72 +184,90 @@ func sanitizeValue(v interface{}) interface{} {
 	}
 }
 
-// generatePDF converts HTML content to PDF using headless Chrome
-// waitMs specifies how long to wait (in milliseconds) for images to load after page ready
-func generatePDF(htmlContent string, waitMs int) ([]byte, error) {
-	allocOpts := append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.Flag("disable-gpu", true),
-	)
-	if config.ChromePath != "" {
-		allocOpts = append(allocOpts, chromedp.ExecPath(config.ChromePath))
-	}
+// renderTimeout bounds one PDF render once it holds a render gate slot,
+// including the wait for a browser
+const renderTimeout = 60 * time.Second
 
-	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), allocOpts...)
-	defer cancel()
+// generatePDF converts HTML content to PDF using a browser from the shared pool.
+// It waits for the page to settle as described by wait and prints with params
+// from PDFOptions.printParams. Resources that failed to load are returned along
+// with the PDF.
+func generatePDF(reqCtx context.Context, htmlContent string, wait pageWait, params *page.PrintToPDFParams) (pdfBuf []byte, failed []ResourceError, err error) {
+	reqCtx, span := tracer.Start(reqCtx, "pdf.generate")
+	defer func() { endSpan(span, err) }()
 
-	ctx, cancel := chromedp.NewContext(allocCtx)
-	defer cancel()
+	// Hold a render gate slot for the whole render, so Chrome never runs more
+	// renders at once than the gate allows whatever started them
+	_, queueSpan := tracer.Start(reqCtx, "render.queue")
+	err = limits.render.acquire(reqCtx)
+	endSpan(queueSpan, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	held := time.Now()
+	defer func() { limits.render.release(time.Since(held)) }()
 
-	// Set a timeout for PDF generation
-	ctx, cancel = context.WithTimeout(ctx, 60*time.Second)
+	// Set a timeout for PDF generation, including time spent waiting for a browser
+	deadline := time.Now().Add(renderTimeout)
+	acquireCtx, cancel := context.WithDeadline(context.WithoutCancel(reqCtx), deadline)
 	defer cancel()
 
-	// Default wait time if not specified
-	if waitMs <= 0 {
-		waitMs = 500
+	// Time each phase of the render: waiting for a browser, loading the page,
+	// waiting for it to settle and printing
+	start := time.Now()
+	phaseDone := func(phase string) chromedp.ActionFunc {
+		return func(context.Context) error {
+			pdfPhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+			start = time.Now()
+			return nil
+		}
 	}
 
-	// Write HTML to a temporary file so Chrome can load it with external resources
-	tmpFile, err := os.CreateTemp("", "pdf-render-*.html")
+	_, acquireSpan := tracer.Start(reqCtx, "chrome.acquire")
+	b, err := pdfPool.acquire(acquireCtx)
+	endSpan(acquireSpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file: %w", err)
+		return nil, nil, err
 	}
-	tmpPath := tmpFile.Name()
-	defer os.Remove(tmpPath)
+	defer func() { pdfPool.release(b, err) }()
+	phaseDone("acquire")(nil)
 
-	if _, err := tmpFile.WriteString(htmlContent); err != nil {
-		tmpFile.Close()
-		return nil, fmt.Errorf("failed to write temp file: %w", err)
-	}
-	tmpFile.Close()
-
-	var pdfBuf []byte
+	// Render in the browser tab, keeping the request ID for logs written while rendering
+	ctx, cancel := context.WithDeadline(b.tab, deadline)
+	defer cancel()
+	ctx = withRequestIDContext(ctx, requestIDFromContext(reqCtx))
 
-	// Navigate to the temp file URL so Chrome can fetch external resources (images)
-	fileURL := "file://" + tmpPath
+	// Serve the page from a virtual origin through the request interceptor, which
+	// also applies the outbound resource policy to everything the page loads
+	pageURL := renderOrigin + "/document.html"
+	watcher := watchPage(ctx)
 
 	if err := chromedp.Run(ctx,
-		chromedp.Navigate(fileURL),
-		chromedp.WaitReady("body"),
-		chromedp.Sleep(time.Duration(waitMs)*time.Millisecond),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			buf, _, err := page.PrintToPDF().
-				WithPrintBackground(true).
-				WithPreferCSSPageSize(true).
-				WithMarginTop(0.4).
-				WithMarginBottom(0.4).
-				WithMarginLeft(0.4).
-				WithMarginRight(0.4).
-				Do(ctx)
+		tracedAction(reqCtx, "network.enable", network.Enable()),
+		tracedAction(reqCtx, "fetch.enable", policy.intercept(ctx, pageURL, htmlContent, watcher)),
+		tracedAction(reqCtx, "navigate", chromedp.Navigate(pageURL)),
+		tracedAction(reqCtx, "wait_ready", chromedp.WaitReady("body")),
+		phaseDone("navigate"),
+		tracedAction(reqCtx, "wait_network_idle", chromedp.ActionFunc(func(ctx context.Context) error {
+			return watcher.wait(ctx, wait.Timeout, wait.Idle)
+		})),
+		tracedAction(reqCtx, "wait_extra", chromedp.Sleep(wait.Extra),
+			attribute.Int64("wait.extra_ms", wait.Extra.Milliseconds())),
+		phaseDone("wait"),
+		tracedAction(reqCtx, "print_to_pdf", chromedp.ActionFunc(func(ctx context.Context) error {
+			buf, _, err := params.Do(ctx)
 			if err != nil {
 				return err
 			}
 			pdfBuf = buf
 			return nil
-		}),
+		})),
+		phaseDone("print"),
 	); err != nil {
-		return nil, fmt.Errorf("chromedp error: %w", err)
+		return nil, nil, fmt.Errorf("chromedp error: %w", err)
 	}
 
-	return pdfBuf, nil
+	failed = watcher.errors()
+	span.SetAttributes(attribute.Int("pdf.bytes", len(pdfBuf)), attribute.Int("pdf.resource_errors", len(failed)))
+	return pdfBuf, failed, nil
 }
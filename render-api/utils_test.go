@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHeaderList(t *testing.T) {
+	if got := headerList([]ResourceError(nil)); got != "[]" {
+		t.Errorf("empty list = %s", got)
+	}
+
+	few := []ResourceError{{URL: "https://a.example/x.png", Error: "HTTP 404"}, {URL: "https://b.example/y.css", Error: "blocked"}}
+	want, _ := json.Marshal(few)
+	if got := headerList(few); got != string(want) {
+		t.Errorf("short list = %s, want %s", got, want)
+	}
+
+	// A long list keeps the leading errors that fit and stays valid JSON
+	var many []ResourceError
+	for i := range 500 {
+		many = append(many, ResourceError{URL: fmt.Sprintf("https://cdn.example/image-%d.png", i), Error: "HTTP 403"})
+	}
+	got := headerList(many)
+	if len(got) > maxErrorHeaderBytes {
+		t.Errorf("header is %d bytes, over %d", len(got), maxErrorHeaderBytes)
+	}
+	var kept []ResourceError
+	if err := json.Unmarshal([]byte(got), &kept); err != nil {
+		t.Fatalf("truncated list isn't JSON: %v", err)
+	}
+	if len(kept) == 0 || len(kept) == len(many) || kept[0] != many[0] || kept[len(kept)-1] != many[len(kept)-1] {
+		t.Errorf("kept %d of %d errors", len(kept), len(many))
+	}
+
+	// An error too long to fit on its own is left out rather than cut
+	huge := []ResourceError{{URL: "https://cdn.example/" + strings.Repeat("a", maxErrorHeaderBytes), Error: "HTTP 414"}}
+	if got := headerList(huge); got != "[]" {
+		t.Errorf("oversized error = %.40s...", got)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// pageReadyJS reports whether every image has finished loading and web fonts are
+// ready, along with the images that loaded broken or are still loading
+const pageReadyJS = `(() => {
+	const imgs = Array.from(document.images);
+	return {
+		images: imgs.every(i => i.complete),
+		fonts: document.fonts.status === "loaded",
+		broken: imgs.filter(i => i.complete && i.naturalWidth === 0 && i.currentSrc).map(i => i.currentSrc),
+		loading: imgs.filter(i => !i.complete).map(i => i.currentSrc || i.src),
+	};
+})()`
+
+// pollInterval is how often a page is checked while waiting for it to settle
+const pollInterval = 50 * time.Millisecond
+
+// ResourceError is a page resource that failed to load before the PDF was printed
+type ResourceError struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// pageWait controls how long generatePDF waits for a page to finish loading
+type pageWait struct {
+	Timeout time.Duration // give up waiting and print after this long
+	Idle    time.Duration // how long the network must be quiet
+	Extra   time.Duration // fixed delay after the page is ready
+}
+
+// pageWait returns the wait strategy of a PDF request
+func (r *PDFRequest) pageWait() pageWait {
+	w := pageWait{
+		Timeout: config.Browser.WaitTimeout,
+		Idle:    config.Browser.NetworkIdle,
+		Extra:   time.Duration(r.WaitAfterLoad) * time.Millisecond,
+	}
+	if t := time.Duration(r.WaitTimeout) * time.Millisecond; t > 0 && t < w.Timeout {
+		w.Timeout = t
+	}
+	return w
+}
+
+// pageState is the result of pageReadyJS
+type pageState struct {
+	Images  bool     `json:"images"`
+	Fonts   bool     `json:"fonts"`
+	Broken  []string `json:"broken"`
+	Loading []string `json:"loading"`
+}
+
+// pageWatcher tracks the network requests of a tab during a render
+type pageWatcher struct {
+	mu           sync.Mutex
+	inflight     map[network.RequestID]string
+	lastActivity time.Time
+	failed       []ResourceError
+	seen         map[string]bool // URLs already in failed
+}
+
+// watchPage starts tracking network requests on the tab in ctx until ctx is done.
+// The network domain must be enabled for events to arrive.
+func watchPage(ctx context.Context) *pageWatcher {
+	w := &pageWatcher{
+		inflight:     make(map[network.RequestID]string),
+		lastActivity: time.Now(),
+		seen:         make(map[string]bool),
+	}
+	chromedp.ListenTarget(ctx, func(ev any) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		switch ev := ev.(type) {
+		case *network.EventRequestWillBeSent:
+			if strings.HasPrefix(ev.Request.URL, "data:") {
+				return
+			}
+			w.inflight[ev.RequestID] = ev.Request.URL
+		case *network.EventResponseReceived:
+			if ev.Response.Status >= 400 {
+				w.fail(ev.Response.URL, fmt.Sprintf("HTTP %d", ev.Response.Status))
+			}
+			return
+		case *network.EventLoadingFinished:
+			delete(w.inflight, ev.RequestID)
+		case *network.EventLoadingFailed:
+			w.fail(w.inflight[ev.RequestID], ev.ErrorText)
+			delete(w.inflight, ev.RequestID)
+		default:
+			return
+		}
+		w.lastActivity = time.Now()
+	})
+	return w
+}
+
+// fail records a failed resource once; callers hold w.mu
+func (w *pageWatcher) fail(rawURL, reason string) {
+	u := displayURL(rawURL)
+	if u == "" || w.seen[u] {
+		return
+	}
+	w.seen[u] = true
+	w.failed = append(w.failed, ResourceError{URL: u, Error: reason})
+}
+
+// record reports a resource that failed or was blocked
+func (w *pageWatcher) record(rawURL, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fail(rawURL, reason)
+}
+
+// idle reports whether no request is in flight and none has finished for d
+func (w *pageWatcher) idle(d time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.inflight) == 0 && time.Since(w.lastActivity) >= d
+}
+
+// wait blocks until the network is idle, every image is loaded and fonts are
+// ready, or the timeout passes. Resources that failed or were still loading
+// are recorded; only CDP errors are returned.
+func (w *pageWatcher) wait(ctx context.Context, timeout, idle time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		timedOut := time.Now().After(deadline)
+		if w.idle(idle) || timedOut {
+			var st pageState
+			if err := chromedp.Evaluate(pageReadyJS, &st).Do(ctx); err != nil {
+				return err
+			}
+			if (st.Images && st.Fonts) || timedOut {
+				w.mu.Lock()
+				for _, src := range st.Broken {
+					w.fail(src, "image failed to load")
+				}
+				if timedOut {
+					for _, u := range w.inflight {
+						w.fail(u, "still loading after wait timeout")
+					}
+					for _, src := range st.Loading {
+						w.fail(src, "still loading after wait timeout")
+					}
+				}
+				w.mu.Unlock()
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// errors returns the resources that failed to load
+func (w *pageWatcher) errors() []ResourceError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]ResourceError(nil), w.failed...)
+}
+
+// displayURL shortens a resource URL for reporting: query strings (which may
+// hold signatures) are dropped and data URLs are reduced to their media type
+func displayURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		if len(raw) > 100 {
+			return raw[:100] + "..."
+		}
+		return raw
+	}
+	if u.Scheme == "data" {
+		media, _, _ := strings.Cut(u.Opaque, ",")
+		return "data:" + media + ",..."
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the webhook body
+const webhookSignatureHeader = "X-Signature-SHA256"
+
+// WebhookPayload is the JSON body POSTed to a job's callback_url
+type WebhookPayload struct {
+	JobID       string    `json:"job_id"`
+	Status      JobStatus `json:"status"`
+	Filename    string    `json:"filename,omitempty"`
+	Size        int       `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`       // hex SHA-256 of the PDF
+	DownloadURL string    `json:"download_url,omitempty"` // where to fetch the PDF
+	PDFBase64   string    `json:"pdf_base64,omitempty"`   // the PDF itself, when callback_inline is set
+	Error       string    `json:"error,omitempty"`
+	SentAt      time.Time `json:"sent_at"`
+
+	// Page resources that failed to load
+	ResourceErrors []ResourceError `json:"resource_errors,omitempty"`
+}
+
+// CallbackState records delivery of a job's completion webhook
+type CallbackState struct {
+	URL       string            `json:"url"`
+	Inline    bool              `json:"inline,omitempty"` // the PDF is sent as pdf_base64
+	Delivered bool              `json:"delivered"`
+	Attempts  []CallbackAttempt `json:"attempts,omitempty"`
+
+	// secret is the request's callback_secret. It never appears in job JSON:
+	// the disk store keeps it in a file of its own until delivery is over.
+	secret string
+}
+
+// CallbackAttempt is one webhook delivery attempt
+type CallbackAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhookSender POSTs signed job notifications
+type webhookSender struct {
+	client *http.Client
+	cfg    WebhookConfig
+}
+
+// newWebhookSender creates a sender using the configured timeout. Deliveries
+// only connect to addresses the outbound policy allows, so a callback URL
+// can't reach private, loopback or metadata addresses, including through DNS
+// or redirects.
+func newWebhookSender(cfg WebhookConfig, p *resourcePolicy) *webhookSender {
+	return &webhookSender{
+		client: &http.Client{Timeout: cfg.Timeout, Transport: tracedTransport(p.transport(cfg.Timeout))},
+		cfg:    cfg,
+	}
+}
+
+// validateCallbackURL checks that a callback URL is an absolute http(s) URL
+// and, when its host is an IP address, that the outbound policy allows it.
+// Host names are checked when the webhook is delivered.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http or https URL")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if err := policy.checkIP(ip); err != nil {
+			return fmt.Errorf("callback_url: %w", err)
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body with the shared secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// downloadURL returns the result link for a job, absolute when a public base URL is configured
+func (s *webhookSender) downloadURL(jobID string) string {
+	return strings.TrimRight(s.cfg.PublicBaseURL, "/") + "/jobs/" + jobID + "/result"
+}
+
+// secretFor returns the signing secret of a job's webhook, falling back to the server default
+func (s *webhookSender) secretFor(cb *CallbackState) string {
+	if cb.secret != "" {
+		return cb.secret
+	}
+	return s.cfg.Secret
+}
+
+// send makes one delivery attempt and reports the receiver's status code
+func (s *webhookSender) send(ctx context.Context, callbackURL, secret string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "render-api-webhook")
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the wait before the given retry (1-based), doubling each time
+func (s *webhookSender) backoff(retry int) time.Duration {
+	d := s.cfg.InitialBackoff << (retry - 1)
+	if d <= 0 || d > s.cfg.MaxBackoff {
+		return s.cfg.MaxBackoff
+	}
+	return d
+}
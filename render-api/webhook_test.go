@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local callback endpoint that records every delivery
+// and answers with the next of its status codes, then 200
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	sigs     []string
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.bodies = append(rcv.bodies, body)
+		rcv.sigs = append(rcv.sigs, r.Header.Get(webhookSignatureHeader))
+		if len(rcv.statuses) > 0 {
+			w.WriteHeader(rcv.statuses[0])
+			rcv.statuses = rcv.statuses[1:]
+		}
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// loopbackPolicy blocks private addresses except loopback, where the test
+// receivers listen
+func loopbackPolicy() *resourcePolicy {
+	return &resourcePolicy{cfg: ResourcePolicyConfig{BlockPrivate: true, AllowedCIDRs: []CIDR{{parseCIDRs("127.0.0.0/8")[0]}}}}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	sender := newWebhookSender(WebhookConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Timeout:        5 * time.Second,
+		PublicBaseURL:  "https://render.example.com/",
+	}, loopbackPolicy())
+	q, err := newJobQueue(JobsConfig{Store: "memory", QueueSize: 1}, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := []byte("%PDF-1.7")
+	sum := sha256.Sum256(pdf)
+	job := &Job{
+		ID:       "9c7026baa3c42a6f6a4d13643bf79500",
+		Status:   JobDone,
+		Filename: "offer.pdf",
+		Size:     len(pdf),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Callback: &CallbackState{URL: rcv.URL, Inline: true, secret: "s3cret"},
+	}
+	q.deliveries.Add(1)
+	q.notify(job, pdf)
+
+	// The first attempt is refused and retried
+	if !job.Callback.Delivered || len(job.Callback.Attempts) != 2 {
+		t.Fatalf("callback = %+v, want delivered on the second attempt", job.Callback)
+	}
+	if job.Callback.secret != "" {
+		t.Error("callback secret kept after delivery")
+	}
+	if got := job.Callback.Attempts[0]; got.StatusCode != http.StatusServiceUnavailable || got.Error == "" {
+		t.Errorf("first attempt = %+v, want a recorded 503", got)
+	}
+	stored, err := q.store.Get(job.ID)
+	if err != nil || !stored.Callback.Delivered {
+		t.Errorf("stored job doesn't record the delivery: %+v, %v", stored, err)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	for i, body := range rcv.bodies {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); rcv.sigs[i] != want {
+			t.Errorf("delivery %d signature = %q, want %q", i, rcv.sigs[i], want)
+		}
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(rcv.bodies[1], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.JobID != job.ID || payload.Status != JobDone || payload.Size != len(pdf) || payload.SHA256 != job.SHA256 {
+		t.Errorf("payload = %+v", payload)
+	}
+	if want := "https://render.example.com/jobs/" + job.ID + "/result"; payload.DownloadURL != want {
+		t.Errorf("download_url = %q, want %q", payload.DownloadURL, want)
+	}
+	if got, _ := base64.StdEncoding.DecodeString(payload.PDFBase64); string(got) != string(pdf) {
+		t.Errorf("pdf_base64 decodes to %q, want the PDF", got)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	sender := newWebhookSender(WebhookConfig{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Timeout: 5 * time.Second}, loopbackPolicy())
+	q, err := newJobQueue(JobsConfig{Store: "memory", QueueSize: 1}, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{ID: "9c7026baa3c42a6f6a4d13643bf79500", Status: JobFailed, Error: "boom", Callback: &CallbackState{URL: rcv.URL}}
+	q.deliveries.Add(1)
+	q.notify(job, nil)
+
+	if job.Callback.Delivered || len(job.Callback.Attempts) != 2 {
+		t.Errorf("callback = %+v, want two failed attempts", job.Callback)
+	}
+	if rcv.sigs[0] != "" {
+		t.Errorf("unsigned delivery sent signature %q", rcv.sigs[0])
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	s := newWebhookSender(WebhookConfig{InitialBackoff: 2 * time.Second, MaxBackoff: 10 * time.Second}, loopbackPolicy())
+	for retry, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 4: 10 * time.Second, 80: 10 * time.Second} {
+		if got := s.backoff(retry); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", retry, got, want)
+		}
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	prev := policy
+	t.Cleanup(func() { policy = prev })
+	policy = &resourcePolicy{cfg: ResourcePolicyConfig{BlockPrivate: true}}
+
+	for raw, ok := range map[string]bool{
+		"https://crm.example.com/hooks/render": true,
+		"http://203.0.113.10:8080/hook":        true,
+		"ftp://example.com/hook":               false,
+		"/hooks/render":                        false,
+		"http://127.0.0.1:8080/hook":           false,
+		"http://169.254.169.254/latest":        false,
+		"http://[::1]/hook":                    false,
+		"https://10.1.2.3/hook":                false,
+	} {
+		if err := validateCallbackURL(raw); (err == nil) != ok {
+			t.Errorf("validateCallbackURL(%q) = %v, want ok %v", raw, err, ok)
+		}
+	}
+}
+
+func TestWebhookBlocksPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	s := newWebhookSender(WebhookConfig{Timeout: defaultConfig().Webhook.Timeout},
+		&resourcePolicy{cfg: ResourcePolicyConfig{BlockPrivate: true}})
+	if _, err := s.send(context.Background(), receiver.URL, "", []byte("{}")); !errors.Is(err, errBlocked) {
+		t.Errorf("delivery to %s: got %v, want a blocked error", receiver.URL, err)
+	}
+
+	s = newWebhookSender(WebhookConfig{Timeout: defaultConfig().Webhook.Timeout}, loopbackPolicy())
+	if status, err := s.send(context.Background(), receiver.URL, "", []byte("{}")); err != nil || status != http.StatusOK {
+		t.Errorf("delivery to an allowed range: got %d, %v", status, err)
+	}
+}